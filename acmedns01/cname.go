@@ -0,0 +1,63 @@
+package acmedns01
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"gopkg.in/hlandau/acmeapi.v2/acmeutils"
+	"time"
+)
+
+// A DNSProvider which follows any chain of CNAME records at the name of a
+// record before creating or removing it using another provider. This
+// supports configurations in which _acme-challenge names are delegated via
+// CNAME records to a dedicated validation zone.
+//
+// The underlying provider must be able to write to the zone at the end of the
+// chain. For RFC2136, leave the Zone field unset so that the zone is
+// determined for each record.
+type CNAMEFollower struct {
+	// Required. The provider used to create and remove the records.
+	Provider DNSProvider
+
+	// Optional. The recursive resolver used to look up CNAME records, in "host"
+	// or "host:port" form. Defaults to the system resolver.
+	Resolver string
+
+	// Optional. The transport to use: "udp" or "tcp". Defaults to "udp".
+	Net string
+
+	// Optional. The timeout for each query. Defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+// Implements DNSProvider.
+func (f *CNAMEFollower) Present(ctx context.Context, name, value string) error {
+	target, _, err := acmeutils.ResolveChallengeTarget(ctx, f.client(), f.Resolver, name)
+	if err != nil {
+		return err
+	}
+
+	return f.Provider.Present(ctx, target, value)
+}
+
+// Implements DNSProvider.
+func (f *CNAMEFollower) CleanUp(ctx context.Context, name, value string) error {
+	target, _, err := acmeutils.ResolveChallengeTarget(ctx, f.client(), f.Resolver, name)
+	if err != nil {
+		return err
+	}
+
+	return f.Provider.CleanUp(ctx, target, value)
+}
+
+func (f *CNAMEFollower) client() *dns.Client {
+	timeout := f.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	return &dns.Client{
+		Net:     f.Net,
+		Timeout: timeout,
+	}
+}
@@ -0,0 +1,38 @@
+package acmedns01
+
+import (
+	"context"
+	"gopkg.in/hlandau/acmeapi.v2/dnstest"
+	"reflect"
+	"testing"
+)
+
+func TestCNAMEFollower(t *testing.T) {
+	s := dnstest.NewServer(t, nil, "example.com", "validation.example.net")
+	defer s.Close()
+
+	s.SetCNAME("_acme-challenge.www.example.com", "www.validation.example.net")
+
+	f := &CNAMEFollower{
+		Provider: &RFC2136{Nameserver: s.Addr},
+		Resolver: s.Addr,
+	}
+
+	err := f.Present(context.TODO(), "_acme-challenge.www.example.com.", "value")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if v := s.TXT("www.validation.example.net"); !reflect.DeepEqual(v, []string{"value"}) {
+		t.Fatalf("unexpected records: %v", v)
+	}
+
+	err = f.CleanUp(context.TODO(), "_acme-challenge.www.example.com.", "value")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if v := s.TXT("www.validation.example.net"); len(v) != 0 {
+		t.Fatalf("unexpected records: %v", v)
+	}
+}
@@ -0,0 +1,78 @@
+// Package acmedns01 provides facilities for responding to ACME dns-01
+// challenges.
+//
+// A DNSProvider creates and removes the TXT records used to answer dns-01
+// challenges. The Present and CleanUp functions determine the record name
+// and value for a challenge and use a DNSProvider to manage the record.
+// PropagationChecker can be used to wait until a record is visible on all
+// authoritative nameservers before responding to the challenge.
+package acmedns01
+
+import (
+	"context"
+	"github.com/hlandau/xlog"
+	"gopkg.in/hlandau/acmeapi.v2/acmeutils"
+	"strings"
+)
+
+var log, Log = xlog.NewQuiet("acmedns01")
+
+// Creates and removes the TXT records used to answer dns-01 challenges.
+// Implementations must be safe for concurrent use.
+type DNSProvider interface {
+	// Creates a TXT record with the given name and value. name is a fully
+	// qualified domain name, with a trailing dot. Any other TXT records with
+	// the same name must be left intact, as multiple challenges for the same
+	// name may be answered at once.
+	Present(ctx context.Context, name, value string) error
+
+	// Removes a TXT record previously created by Present. Any other TXT records
+	// with the same name must be left intact.
+	CleanUp(ctx context.Context, name, value string) error
+}
+
+// Returns the fully qualified name (with a trailing dot) of the TXT record
+// used to answer a dns-01 challenge for the given hostname. Wildcard hostnames
+// use the same record as the hostname without the wildcard label.
+func ChallengeRecordName(hostname string) (string, error) {
+	hostname, err := acmeutils.NormalizeHostname(hostname)
+	if err != nil {
+		return "", err
+	}
+
+	return "_acme-challenge." + strings.TrimPrefix(hostname, "*.") + ".", nil
+}
+
+// Returns the fully qualified name and value of the TXT record used to
+// answer a dns-01 challenge for the given hostname, account key and token.
+func ChallengeRecord(accountKey interface{}, hostname, token string) (name, value string, err error) {
+	name, err = ChallengeRecordName(hostname)
+	if err != nil {
+		return
+	}
+
+	value, err = acmeutils.DNSKeyAuthorization(accountKey, token)
+	return
+}
+
+// Starts answering a dns-01 challenge for the given hostname by creating the
+// TXT record using the given provider.
+func Present(ctx context.Context, p DNSProvider, accountKey interface{}, hostname, token string) error {
+	name, value, err := ChallengeRecord(accountKey, hostname, token)
+	if err != nil {
+		return err
+	}
+
+	return p.Present(ctx, name, value)
+}
+
+// Stops answering a dns-01 challenge for the given hostname by removing the
+// TXT record using the given provider.
+func CleanUp(ctx context.Context, p DNSProvider, accountKey interface{}, hostname, token string) error {
+	name, value, err := ChallengeRecord(accountKey, hostname, token)
+	if err != nil {
+		return err
+	}
+
+	return p.CleanUp(ctx, name, value)
+}
@@ -0,0 +1,210 @@
+package acmedns01
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"gopkg.in/hlandau/acmeapi.v2/acmeutils"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Checks that a TXT record created to answer a dns-01 challenge is visible
+// on all authoritative nameservers for its zone, so that the challenge can be
+// responded to without risking validation against a nameserver which has not
+// yet received the record.
+//
+// The zone and its nameservers are determined using a recursive resolver;
+// the nameservers themselves are then queried directly.
+type PropagationChecker struct {
+	// Optional. The address of the recursive resolver used to determine the
+	// zone and its nameservers, in "host" or "host:port" form. Defaults to the
+	// first nameserver listed in /etc/resolv.conf.
+	Resolver string
+
+	// Optional. The interval between checks. Defaults to 5 seconds.
+	Interval time.Duration
+
+	// Optional. The timeout for each query. Defaults to 10 seconds.
+	Timeout time.Duration
+
+	// Optional. The port on which authoritative nameservers are queried.
+	// Defaults to 53.
+	NameserverPort string
+}
+
+// Waits until a TXT record with the given name and value is visible on all
+// authoritative nameservers for the zone containing name, or until ctx is
+// done. name must be fully qualified. Only once this returns nil should the
+// dns-01 challenge be responded to.
+func (pc *PropagationChecker) Wait(ctx context.Context, name, value string) error {
+	resolver, err := pc.resolver()
+	if err != nil {
+		return err
+	}
+
+	c := pc.client()
+	name = dns.Fqdn(strings.ToLower(name))
+
+	zone, err := acmeutils.FindZone(ctx, c, resolver, name)
+	if err != nil {
+		return err
+	}
+
+	nameservers, err := pc.nameservers(ctx, c, resolver, zone)
+	if err != nil {
+		return err
+	}
+
+	interval := pc.Interval
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+
+	for {
+		var pending []string
+		for _, ns := range nameservers {
+			ok, err := hasTXT(ctx, c, ns, name, value)
+			if err != nil {
+				log.Debugf("error checking %q on %q: %v", name, ns, err)
+			}
+			if !ok {
+				pending = append(pending, ns)
+			}
+		}
+
+		if len(pending) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("TXT record %q not visible on nameservers %v: %v", name, pending, ctx.Err())
+		case <-time.After(interval):
+		}
+
+		nameservers = pending
+	}
+}
+
+func (pc *PropagationChecker) resolver() (string, error) {
+	if pc.Resolver != "" {
+		return pc.Resolver, nil
+	}
+
+	return acmeutils.SystemResolver()
+}
+
+func (pc *PropagationChecker) client() *dns.Client {
+	timeout := pc.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	return &dns.Client{
+		Timeout: timeout,
+	}
+}
+
+// Returns the addresses of the authoritative nameservers for zone, in
+// "host:port" form.
+func (pc *PropagationChecker) nameservers(ctx context.Context, c *dns.Client, resolver, zone string) ([]string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeNS)
+
+	res, _, err := c.ExchangeContext(ctx, m, acmeutils.DNSServerAddr(resolver))
+	if err != nil {
+		return nil, err
+	}
+
+	port := pc.NameserverPort
+	if port == "" {
+		port = "53"
+	}
+
+	seen := map[string]struct{}{}
+	var addrs []string
+	for _, rr := range res.Answer {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+
+		ips, err := resolveHost(ctx, c, resolver, ns.Ns)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ip := range ips {
+			addr := net.JoinHostPort(ip, port)
+			if _, ok := seen[addr]; !ok {
+				seen[addr] = struct{}{}
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no nameservers found for zone %q", zone)
+	}
+
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+// Returns the IPv4 and IPv6 addresses of a host.
+func resolveHost(ctx context.Context, c *dns.Client, resolver, host string) ([]string, error) {
+	var ips []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(host), qtype)
+
+		res, _, err := c.ExchangeContext(ctx, m, acmeutils.DNSServerAddr(resolver))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, rr := range res.Answer {
+			switch v := rr.(type) {
+			case *dns.A:
+				ips = append(ips, v.A.String())
+			case *dns.AAAA:
+				ips = append(ips, v.AAAA.String())
+			}
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("cannot resolve nameserver %q", host)
+	}
+
+	return ips, nil
+}
+
+// Returns true iff the given server returns a TXT record with the given name
+// and value. Recursion is not requested, as the server is expected to be
+// authoritative.
+func hasTXT(ctx context.Context, c *dns.Client, server, name, value string) (bool, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeTXT)
+	m.RecursionDesired = false
+
+	res, _, err := c.ExchangeContext(ctx, m, server)
+	if err != nil {
+		return false, err
+	}
+
+	if res.Rcode != dns.RcodeSuccess {
+		return false, nil
+	}
+
+	for _, rr := range res.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
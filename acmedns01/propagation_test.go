@@ -0,0 +1,42 @@
+package acmedns01
+
+import (
+	"context"
+	"gopkg.in/hlandau/acmeapi.v2/dnstest"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPropagationChecker(t *testing.T) {
+	s := dnstest.NewServer(t, nil, "example.com")
+	defer s.Close()
+
+	_, port, _ := net.SplitHostPort(s.Addr)
+	s.SetNS("example.com", map[string]string{"ns1.example.com": "127.0.0.1"})
+
+	pc := &PropagationChecker{
+		Resolver:       s.Addr,
+		Interval:       10 * time.Millisecond,
+		NameserverPort: port,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := pc.Wait(ctx, "_acme-challenge.www.example.com.", "value")
+	if err == nil {
+		t.Fatalf("wait succeeded before record was present")
+	}
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		s.SetTXT("_acme-challenge.www.example.com", "other", "value")
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = pc.Wait(ctx, "_acme-challenge.www.example.com.", "value")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package acmedns01
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"gopkg.in/hlandau/acmeapi.v2/acmeutils"
+	"strings"
+	"time"
+)
+
+// A DNSProvider which creates and removes records by sending RFC 2136
+// dynamic update messages to an authoritative nameserver, such as BIND
+// configured to accept updates from nsupdate.
+type RFC2136 struct {
+	// Required. The address of the authoritative nameserver to which updates
+	// are sent, in "host" or "host:port" form. The port defaults to 53.
+	Nameserver string
+
+	// Optional. The zone to update. If this is not set, the zone containing
+	// each record is determined by querying Nameserver for its SOA record.
+	Zone string
+
+	// Optional. The name of the TSIG key used to authenticate updates. If this
+	// is not set, updates are not authenticated.
+	TSIGKeyName string
+
+	// The TSIG key, base64 encoded. Required if TSIGKeyName is set.
+	TSIGSecret string
+
+	// Optional. The TSIG algorithm, e.g. "hmac-sha256." (see the miekg/dns
+	// package for supported algorithms). Defaults to HMAC-SHA256.
+	TSIGAlgorithm string
+
+	// Optional. The TTL of created records. Defaults to 60 seconds.
+	TTL uint32
+
+	// Optional. The transport to use: "udp" or "tcp". Defaults to "udp".
+	Net string
+
+	// Optional. The timeout for each request. Defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+// Implements DNSProvider.
+func (p *RFC2136) Present(ctx context.Context, name, value string) error {
+	return p.update(ctx, name, value, true)
+}
+
+// Implements DNSProvider.
+func (p *RFC2136) CleanUp(ctx context.Context, name, value string) error {
+	return p.update(ctx, name, value, false)
+}
+
+func (p *RFC2136) update(ctx context.Context, name, value string, insert bool) error {
+	name = dns.Fqdn(strings.ToLower(name))
+
+	zone := p.Zone
+	if zone == "" {
+		var err error
+		zone, err = acmeutils.FindZone(ctx, p.client(), p.Nameserver, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	ttl := p.TTL
+	if ttl == 0 {
+		ttl = 60
+	}
+
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Txt: []string{value},
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	if insert {
+		m.Insert([]dns.RR{rr})
+	} else {
+		m.Remove([]dns.RR{rr})
+	}
+
+	if p.TSIGKeyName != "" {
+		alg := p.TSIGAlgorithm
+		if alg == "" {
+			alg = dns.HmacSHA256
+		}
+
+		m.SetTsig(dns.Fqdn(p.TSIGKeyName), dns.Fqdn(alg), 300, time.Now().Unix())
+	}
+
+	res, _, err := p.client().ExchangeContext(ctx, m, acmeutils.DNSServerAddr(p.Nameserver))
+	if err != nil {
+		return err
+	}
+
+	if res.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("DNS update for %q in zone %q failed: %s", name, zone, dns.RcodeToString[res.Rcode])
+	}
+
+	return nil
+}
+
+func (p *RFC2136) client() *dns.Client {
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	c := &dns.Client{
+		Net:     p.Net,
+		Timeout: timeout,
+	}
+	if p.TSIGKeyName != "" {
+		c.TsigSecret = map[string]string{dns.Fqdn(p.TSIGKeyName): p.TSIGSecret}
+	}
+
+	return c
+}
@@ -0,0 +1,81 @@
+package acmedns01
+
+import (
+	"context"
+	"gopkg.in/hlandau/acmeapi.v2/dnstest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRFC2136(t *testing.T) {
+	const secret = "c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0LXNlY3JldA=="
+	s := dnstest.NewServer(t, map[string]string{"acme-key.": secret}, "example.com")
+	defer s.Close()
+
+	p := &RFC2136{
+		Nameserver:  s.Addr,
+		TSIGKeyName: "acme-key",
+		TSIGSecret:  secret,
+	}
+
+	s.SetTXT("_acme-challenge.www.example.com", "existing")
+
+	err := p.Present(context.TODO(), "_acme-challenge.www.example.com.", "value-1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	err = p.Present(context.TODO(), "_acme-challenge.www.example.com.", "value-2")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if v := s.TXT("_acme-challenge.www.example.com"); !reflect.DeepEqual(v, []string{"existing", "value-1", "value-2"}) {
+		t.Fatalf("unexpected records: %v", v)
+	}
+
+	err = p.CleanUp(context.TODO(), "_acme-challenge.www.example.com.", "value-1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if v := s.TXT("_acme-challenge.www.example.com"); !reflect.DeepEqual(v, []string{"existing", "value-2"}) {
+		t.Fatalf("unexpected records: %v", v)
+	}
+
+	// Wrong key.
+	p.TSIGSecret = "d3Jvbmc="
+	err = p.Present(context.TODO(), "_acme-challenge.www.example.com.", "value-3")
+	if err == nil {
+		t.Fatalf("update with wrong TSIG key succeeded")
+	}
+
+	// Name outside any zone served.
+	p.TSIGSecret = secret
+	err = p.Present(context.TODO(), "_acme-challenge.example.net.", "value-3")
+	if err == nil {
+		t.Fatalf("update outside zone succeeded")
+	}
+}
+
+func TestRFC2136TCP(t *testing.T) {
+	s := dnstest.NewServerNet(t, "tcp", nil, "example.com")
+	defer s.Close()
+
+	// Zone discovery must also use TCP, as the server does not listen on UDP.
+	p := &RFC2136{
+		Nameserver: s.Addr,
+		Net:        "tcp",
+		Timeout:    2 * time.Second,
+	}
+
+	err := p.Present(context.TODO(), "_acme-challenge.www.example.com.", "value-1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if v := s.TXT("_acme-challenge.www.example.com"); !reflect.DeepEqual(v, []string{"value-1"}) {
+		t.Fatalf("unexpected records: %v", v)
+	}
+}
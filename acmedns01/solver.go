@@ -0,0 +1,59 @@
+package acmedns01
+
+import (
+	"context"
+	"gopkg.in/hlandau/acmeapi.v2"
+)
+
+// Answers dns-01 challenges using a DNSProvider. Implements
+// acmeapi.ChallengeSolver, so that it can be passed to RealmClient.Obtain.
+type Solver struct {
+	// Required. Creates and removes the TXT records.
+	Provider DNSProvider
+
+	// Optional. If set, Present waits until the TXT record is visible on all
+	// authoritative nameservers before returning, so that the challenge is
+	// not responded to before the record has propagated.
+	PropagationChecker *PropagationChecker
+}
+
+// Implements acmeapi.ChallengeSolver.
+func (s *Solver) ChallengeType() string {
+	return "dns-01"
+}
+
+// Implements acmeapi.ChallengeSolver.
+func (s *Solver) Present(ctx context.Context, acct *acmeapi.Account, az *acmeapi.Authorization, ch *acmeapi.Challenge) error {
+	name, value, err := ChallengeRecord(acct.PrivateKey, az.Identifier.Value, ch.Token)
+	if err != nil {
+		return err
+	}
+
+	err = s.Provider.Present(ctx, name, value)
+	if err != nil {
+		return err
+	}
+
+	if s.PropagationChecker == nil {
+		return nil
+	}
+
+	err = s.PropagationChecker.Wait(ctx, name, value)
+	if err != nil {
+		// CleanUp is not called if Present fails, so remove the record here.
+		// ctx may have been cancelled.
+		cerr := s.Provider.CleanUp(context.Background(), name, value)
+		if cerr != nil {
+			log.Errorf("failed to remove TXT record %q: %v", name, cerr)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Implements acmeapi.ChallengeSolver.
+func (s *Solver) CleanUp(ctx context.Context, acct *acmeapi.Account, az *acmeapi.Authorization, ch *acmeapi.Challenge) error {
+	return CleanUp(ctx, s.Provider, acct.PrivateKey, az.Identifier.Value, ch.Token)
+}
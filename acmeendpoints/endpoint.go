@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"regexp"
 	"sync"
+	"time"
 )
 
 // Provides information on a known ACME endpoint.
@@ -36,9 +37,35 @@ type Endpoint struct {
 	DeprecatedDirectoryURLRegexp string
 	deprecatedDirectoryURLRegexp *regexp.Regexp
 
+	// The rate limits imposed by the endpoint, where known. These can be used
+	// to configure a client-side rate limiter so that requests which would
+	// exceed a limit are not made.
+	RateLimits RateLimits
+
 	initOnce sync.Once
 }
 
+// Rate limits imposed by an endpoint. A limit with a zero Count is unknown or
+// not imposed.
+type RateLimits struct {
+	// Limits the creation of new orders by an account.
+	NewOrdersPerAccount RateLimit
+
+	// Limits the creation of new accounts from a single IP address.
+	NewAccountsPerIP RateLimit
+
+	// Limits failed validations for a given identifier by an account. Once
+	// reached, new orders for the identifier are refused.
+	FailedValidationsPerIdentifier RateLimit
+}
+
+// A rate limit: no more than Count operations are permitted in any interval
+// of length Period.
+type RateLimit struct {
+	Count  int
+	Period time.Duration
+}
+
 func (e *Endpoint) String() string {
 	return fmt.Sprintf("Endpoint(%v)", e.DirectoryURL)
 }
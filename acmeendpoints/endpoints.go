@@ -1,5 +1,7 @@
 package acmeendpoints
 
+import "time"
+
 var (
 	// Let's Encrypt (Live v2)
 	LetsEncryptLiveV2 = Endpoint{
@@ -9,6 +11,11 @@ var (
 		OCSPURLRegexp:                `^http://ocsp\.int-[^.]+\.letsencrypt\.org\.?/.*$`,
 		DeprecatedDirectoryURLRegexp: `^https://acme-v01\.api\.letsencrypt\.org/directory$`,
 		Live:                         true,
+		RateLimits: RateLimits{
+			NewOrdersPerAccount:            RateLimit{300, 3 * time.Hour},
+			NewAccountsPerIP:               RateLimit{10, 3 * time.Hour},
+			FailedValidationsPerIdentifier: RateLimit{5, 1 * time.Hour},
+		},
 	}
 
 	// Let's Encrypt (Staging v2)
@@ -18,6 +25,10 @@ var (
 		DirectoryURL:  "https://acme-staging-v02.api.letsencrypt.org/directory",
 		OCSPURLRegexp: `^http://ocsp\.(staging|stg-int)-[^.]+\.letsencrypt\.org\.?/.*$`,
 		Live:          false,
+		RateLimits: RateLimits{
+			NewOrdersPerAccount: RateLimit{1500, 3 * time.Hour},
+			NewAccountsPerIP:    RateLimit{50, 3 * time.Hour},
+		},
 	}
 )
 
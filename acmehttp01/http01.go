@@ -0,0 +1,226 @@
+// Package acmehttp01 provides facilities for responding to ACME http-01
+// challenges.
+//
+// A Store holds the key authorizations for the challenges currently being
+// answered and serves them over HTTP, either as part of an existing HTTP
+// server (see Store.Middleware) or standalone (see ListenAndServe).
+// Alternatively, Webroot writes key authorizations as files under the
+// document root of an existing web server.
+package acmehttp01
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/hlandau/acmeapi.v2/acmeutils"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The path prefix under which http-01 challenge responses are served.
+const WellKnownPath = "/.well-known/acme-challenge/"
+
+var reToken = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func validateToken(token string) error {
+	if !reToken.MatchString(token) {
+		return fmt.Errorf("invalid challenge token: %q", token)
+	}
+
+	return nil
+}
+
+// Stores the key authorizations for the http-01 challenges being answered
+// and serves them over HTTP. It is safe for concurrent use. The zero value is
+// an empty store ready for use.
+type Store struct {
+	mutex             sync.RWMutex
+	keyAuthorizations map[string]string
+}
+
+// Starts answering the challenge with the given token, using the given
+// account key to form the key authorization.
+func (s *Store) Present(accountKey interface{}, token string) error {
+	err := validateToken(token)
+	if err != nil {
+		return err
+	}
+
+	ka, err := acmeutils.KeyAuthorization(accountKey, token)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.keyAuthorizations == nil {
+		s.keyAuthorizations = map[string]string{}
+	}
+
+	s.keyAuthorizations[token] = ka
+	return nil
+}
+
+// Stops answering the challenge with the given token.
+func (s *Store) CleanUp(token string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.keyAuthorizations, token)
+	return nil
+}
+
+// Returns the key authorization for the challenge with the given token, if
+// it is being answered.
+func (s *Store) Get(token string) (keyAuthorization string, ok bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	keyAuthorization, ok = s.keyAuthorizations[token]
+	return
+}
+
+// Serves challenge responses. Requests for paths other than those under
+// WellKnownPath, and for tokens not in the store, receive a 404 response.
+func (s *Store) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !s.serve(rw, req) {
+		http.NotFound(rw, req)
+	}
+}
+
+// Returns a handler which serves challenge responses from the store and
+// passes all other requests to next.
+func (s *Store) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !s.serve(rw, req) {
+			next.ServeHTTP(rw, req)
+		}
+	})
+}
+
+func (s *Store) serve(rw http.ResponseWriter, req *http.Request) bool {
+	if (req.Method != "GET" && req.Method != "HEAD") || !strings.HasPrefix(req.URL.Path, WellKnownPath) {
+		return false
+	}
+
+	ka, ok := s.Get(req.URL.Path[len(WellKnownPath):])
+	if !ok {
+		return false
+	}
+
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.Write([]byte(ka))
+	return true
+}
+
+// Serves challenge responses from the store on the given address (usually
+// ":80") until ctx is cancelled. Requests for anything other than challenge
+// responses receive a 404 response. Returns nil once ctx is cancelled, or an
+// error if the server could not be started.
+func ListenAndServe(ctx context.Context, addr string, s *Store) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler:      s,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- srv.Serve(l)
+	}()
+
+	select {
+	case <-ctx.Done():
+		srv.Close()
+		<-errChan
+		return nil
+	case err := <-errChan:
+		return err
+	}
+}
+
+// Answers http-01 challenges by writing files under the document root of an
+// existing web server.
+type Webroot struct {
+	// The document root of the web server. Challenge response files are
+	// written under the .well-known/acme-challenge directory beneath this
+	// path, which is created if it does not exist.
+	Path string
+}
+
+func (w *Webroot) filename(token string) string {
+	return filepath.Join(w.Path, filepath.FromSlash(WellKnownPath), token)
+}
+
+// Starts answering the challenge with the given token, using the given
+// account key to form the key authorization. The file is written atomically,
+// so that the web server never serves a partially written response.
+func (w *Webroot) Present(accountKey interface{}, token string) error {
+	err := validateToken(token)
+	if err != nil {
+		return err
+	}
+
+	ka, err := acmeutils.KeyAuthorization(accountKey, token)
+	if err != nil {
+		return err
+	}
+
+	fn := w.filename(token)
+	dir := filepath.Dir(fn)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, ".tmp-"+token+"-")
+	if err != nil {
+		return err
+	}
+
+	tmpName := f.Name()
+	_, err = f.Write([]byte(ka))
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, fn)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return nil
+}
+
+// Stops answering the challenge with the given token by removing its file.
+// It is not an error if the file does not exist.
+func (w *Webroot) CleanUp(token string) error {
+	err := validateToken(token)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(w.filename(token))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
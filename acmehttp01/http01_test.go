@@ -0,0 +1,171 @@
+package acmehttp01
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"gopkg.in/hlandau/acmeapi.v2/acmeutils"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, url string) (int, string) {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	return res.StatusCode, string(b)
+}
+
+func TestStore(t *testing.T) {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal()
+	}
+
+	ka, err := acmeutils.KeyAuthorization(pk, "tok_en-1")
+	if err != nil {
+		t.Fatal()
+	}
+
+	s := &Store{}
+	err = s.Present(pk, "tok_en-1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if s.Present(pk, "../etc/passwd") == nil {
+		t.Fatalf("invalid token accepted")
+	}
+
+	srv := httptest.NewServer(s.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("next"))
+	})))
+	defer srv.Close()
+
+	code, body := get(t, srv.URL+WellKnownPath+"tok_en-1")
+	if code != 200 || body != ka {
+		t.Fatalf("unexpected response: %v %q", code, body)
+	}
+
+	code, body = get(t, srv.URL+WellKnownPath+"other")
+	if code != 200 || body != "next" {
+		t.Fatalf("unexpected response: %v %q", code, body)
+	}
+
+	s.CleanUp("tok_en-1")
+	code, body = get(t, srv.URL+WellKnownPath+"tok_en-1")
+	if code != 200 || body != "next" {
+		t.Fatalf("unexpected response: %v %q", code, body)
+	}
+
+	// Standalone mode.
+	err = s.Present(pk, "tok_en-1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- ListenAndServe(ctx, addr, s)
+	}()
+
+	for i := 0; ; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatalf("standalone server did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	code, body = get(t, "http://"+addr+WellKnownPath+"tok_en-1")
+	if code != 200 || body != ka {
+		t.Fatalf("unexpected response: %v %q", code, body)
+	}
+
+	code, _ = get(t, "http://"+addr+"/")
+	if code != 404 {
+		t.Fatalf("unexpected response: %v", code)
+	}
+
+	cancel()
+	err = <-errChan
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestWebroot(t *testing.T) {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal()
+	}
+
+	ka, err := acmeutils.KeyAuthorization(pk, "token")
+	if err != nil {
+		t.Fatal()
+	}
+
+	dir, err := ioutil.TempDir("", "acmehttp01")
+	if err != nil {
+		t.Fatal()
+	}
+	defer os.RemoveAll(dir)
+
+	w := &Webroot{Path: dir}
+	err = w.Present(pk, "token")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	challengeDir := filepath.Join(dir, ".well-known", "acme-challenge")
+	b, err := ioutil.ReadFile(filepath.Join(challengeDir, "token"))
+	if err != nil || string(b) != ka {
+		t.Fatalf("unexpected file contents: %q, %v", b, err)
+	}
+
+	fis, err := ioutil.ReadDir(challengeDir)
+	if err != nil || len(fis) != 1 {
+		t.Fatalf("unexpected files in challenge directory: %v", fis)
+	}
+
+	err = w.CleanUp("token")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	_, err = os.Stat(filepath.Join(challengeDir, "token"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("file not removed")
+	}
+
+	err = w.CleanUp("token")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package acmehttp01
+
+import (
+	"context"
+	"gopkg.in/hlandau/acmeapi.v2"
+)
+
+// Makes key authorizations for http-01 challenges available. Implemented by
+// Store and Webroot.
+type Responder interface {
+	// Starts answering the challenge with the given token.
+	Present(accountKey interface{}, token string) error
+
+	// Stops answering the challenge with the given token.
+	CleanUp(token string) error
+}
+
+// Answers http-01 challenges using a Responder, such as a Store or Webroot.
+// Implements acmeapi.ChallengeSolver, so that it can be passed to
+// RealmClient.Obtain.
+type Solver struct {
+	// Required. Serves the key authorizations.
+	Responder Responder
+}
+
+// Implements acmeapi.ChallengeSolver.
+func (s *Solver) ChallengeType() string {
+	return "http-01"
+}
+
+// Implements acmeapi.ChallengeSolver.
+func (s *Solver) Present(ctx context.Context, acct *acmeapi.Account, az *acmeapi.Authorization, ch *acmeapi.Challenge) error {
+	return s.Responder.Present(acct.PrivateKey, ch.Token)
+}
+
+// Implements acmeapi.ChallengeSolver.
+func (s *Solver) CleanUp(ctx context.Context, acct *acmeapi.Account, az *acmeapi.Authorization, ch *acmeapi.Challenge) error {
+	return s.Responder.CleanUp(ch.Token)
+}
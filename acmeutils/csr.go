@@ -0,0 +1,45 @@
+package acmeutils
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+)
+
+// Creates a DER-encoded CSR requesting a certificate for the given names,
+// signed using the given private key. Each name may be a hostname or an IP
+// address. IP addresses are requested as IP address SANs and hostnames as DNS
+// name SANs. The first hostname, if any and if short enough, is also used as
+// the subject common name.
+//
+// The private key may be an RSA, ECDSA or Ed25519 key. Not all CAs accept
+// Ed25519 keys in CSRs.
+func CreateCSR(privateKey crypto.PrivateKey, names []string) ([]byte, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("at least one name must be specified")
+	}
+
+	csr := &x509.CertificateRequest{}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			csr.IPAddresses = append(csr.IPAddresses, ip)
+			continue
+		}
+
+		hostname, err := NormalizeHostname(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if csr.Subject.CommonName == "" && len(hostname) <= 64 {
+			csr.Subject = pkix.Name{CommonName: hostname}
+		}
+
+		csr.DNSNames = append(csr.DNSNames, hostname)
+	}
+
+	return x509.CreateCertificateRequest(rand.Reader, csr, privateKey)
+}
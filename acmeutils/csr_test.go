@@ -0,0 +1,56 @@
+package acmeutils
+
+import (
+	"crypto/x509"
+	"reflect"
+	"testing"
+)
+
+func TestCreateCSR(t *testing.T) {
+	pk, err := LoadPrivateKey([]byte(testECKey))
+	if err != nil {
+		t.Fatal()
+	}
+
+	der, err := CreateCSR(pk, []string{"192.0.2.1", "Example.com", "2001:db8::1", "www.example.com"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if !reflect.DeepEqual(csr.DNSNames, []string{"example.com", "www.example.com"}) {
+		t.Fatalf("unexpected DNS names: %v", csr.DNSNames)
+	}
+
+	if len(csr.IPAddresses) != 2 || csr.IPAddresses[0].String() != "192.0.2.1" || csr.IPAddresses[1].String() != "2001:db8::1" {
+		t.Fatalf("unexpected IP addresses: %v", csr.IPAddresses)
+	}
+
+	if csr.Subject.CommonName != "example.com" {
+		t.Fatalf("unexpected common name: %q", csr.Subject.CommonName)
+	}
+
+	_, err = CreateCSR(pk, nil)
+	if err == nil {
+		t.Fatal()
+	}
+
+	edpk, err := LoadPrivateKey([]byte(testEdKey))
+	if err != nil {
+		t.Fatal()
+	}
+
+	der, err = CreateCSR(edpk, []string{"example.com"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	csr, err = x509.ParseCertificateRequest(der)
+	if err != nil || csr.PublicKeyAlgorithm != x509.Ed25519 || csr.CheckSignature() != nil {
+		t.Fatalf("invalid Ed25519 CSR: %v", err)
+	}
+}
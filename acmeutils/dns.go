@@ -0,0 +1,176 @@
+package acmeutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// The maximum number of CNAME records followed by ResolveChallengeTarget.
+const MaxCNAMEChainLength = 10
+
+// Returned by ResolveChallengeTarget if a CNAME loop is detected.
+var ErrCNAMELoop = errors.New("CNAME loop detected")
+
+// Returned by ResolveChallengeTarget if the CNAME chain is too long.
+var ErrCNAMEChainTooLong = errors.New("CNAME chain too long")
+
+// Returns the address of the system's recursive resolver, as configured in
+// /etc/resolv.conf, in "host:port" form.
+func SystemResolver() (string, error) {
+	cfg, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+
+	if len(cfg.Servers) == 0 {
+		return "", fmt.Errorf("no nameservers configured in /etc/resolv.conf")
+	}
+
+	return net.JoinHostPort(cfg.Servers[0], cfg.Port), nil
+}
+
+// Returns the address of a DNS server in "host:port" form. addr may be given
+// as a hostname or IP address, with or without a port; if no port is given,
+// the default DNS port, 53, is used. IPv6 addresses may be given with or
+// without brackets.
+func DNSServerAddr(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+
+	host := addr
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+
+	return net.JoinHostPort(host, "53")
+}
+
+func resolverAddr(resolver string) (string, error) {
+	if resolver == "" {
+		return SystemResolver()
+	}
+
+	return DNSServerAddr(resolver), nil
+}
+
+// Determines the zone containing the given name by querying the given
+// resolver for the SOA record of the name. The resolver is given in "host"
+// or "host:port" form; if it is "", the system resolver is used. The zone is
+// returned as a fully qualified name with a trailing dot.
+//
+// The query is made using c, which determines the transport and timeout used.
+// If c is nil, a default client using UDP is used.
+func FindZone(ctx context.Context, c *dns.Client, resolver, name string) (string, error) {
+	addr, err := resolverAddr(resolver)
+	if err != nil {
+		return "", err
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeSOA)
+
+	res, _, err := orDefaultClient(c).ExchangeContext(ctx, m, addr)
+	if err != nil {
+		return "", err
+	}
+
+	if res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+		return "", fmt.Errorf("cannot determine zone for %q: %s", name, dns.RcodeToString[res.Rcode])
+	}
+
+	// The SOA record is in the answer section if name is the zone apex, and
+	// in the authority section otherwise.
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns} {
+		for _, rr := range rrs {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return strings.ToLower(soa.Hdr.Name), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("cannot determine zone for %q: no SOA record returned", name)
+}
+
+// Determines where a DNS challenge record must actually be written. Starting
+// from the given record name (for example, "_acme-challenge.example.com."),
+// any chain of CNAME records is followed, and the final name in the chain is
+// returned along with the zone containing it. If there is no CNAME record at
+// name, name itself is returned.
+//
+// This allows the challenge record names of many domains to be delegated to
+// a dedicated validation zone. The client and resolver are given as for
+// FindZone. If a loop is detected, ErrCNAMELoop is returned; if the chain is
+// longer than MaxCNAMEChainLength, ErrCNAMEChainTooLong is returned.
+func ResolveChallengeTarget(ctx context.Context, c *dns.Client, resolver, name string) (recordName, zone string, err error) {
+	addr, err := resolverAddr(resolver)
+	if err != nil {
+		return
+	}
+
+	recordName = dns.Fqdn(strings.ToLower(name))
+	seen := map[string]struct{}{}
+	for {
+		seen[recordName] = struct{}{}
+
+		var target string
+		target, err = lookupCNAME(ctx, c, addr, recordName)
+		if err != nil {
+			return
+		}
+
+		if target == "" {
+			break
+		}
+
+		if _, ok := seen[target]; ok {
+			err = ErrCNAMELoop
+			return
+		}
+
+		if len(seen) > MaxCNAMEChainLength {
+			err = ErrCNAMEChainTooLong
+			return
+		}
+
+		recordName = target
+	}
+
+	zone, err = FindZone(ctx, c, addr, recordName)
+	return
+}
+
+// Returns the target of the CNAME record at name, or "" if there is none.
+func lookupCNAME(ctx context.Context, c *dns.Client, addr, name string) (string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeCNAME)
+
+	res, _, err := orDefaultClient(c).ExchangeContext(ctx, m, addr)
+	if err != nil {
+		return "", err
+	}
+
+	if res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+		return "", fmt.Errorf("cannot look up CNAME for %q: %s", name, dns.RcodeToString[res.Rcode])
+	}
+
+	for _, rr := range res.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+			return dns.Fqdn(strings.ToLower(cname.Target)), nil
+		}
+	}
+
+	return "", nil
+}
+
+func orDefaultClient(c *dns.Client) *dns.Client {
+	if c == nil {
+		return new(dns.Client)
+	}
+
+	return c
+}
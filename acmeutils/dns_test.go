@@ -0,0 +1,63 @@
+package acmeutils
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/hlandau/acmeapi.v2/dnstest"
+	"testing"
+)
+
+func TestDNSServerAddr(t *testing.T) {
+	for _, tc := range []struct{ In, Out string }{
+		{"192.0.2.1", "192.0.2.1:53"},
+		{"192.0.2.1:5353", "192.0.2.1:5353"},
+		{"ns.example.com", "ns.example.com:53"},
+		{"ns.example.com:5353", "ns.example.com:5353"},
+		{"2001:db8::1", "[2001:db8::1]:53"},
+		{"[2001:db8::1]", "[2001:db8::1]:53"},
+		{"[2001:db8::1]:5353", "[2001:db8::1]:5353"},
+	} {
+		if out := DNSServerAddr(tc.In); out != tc.Out {
+			t.Errorf("%q: got %q, expected %q", tc.In, out, tc.Out)
+		}
+	}
+}
+
+func TestResolveChallengeTarget(t *testing.T) {
+	s := dnstest.NewServer(t, nil, "example.com.", "validation.example.net.")
+	defer s.Close()
+
+	s.SetCNAME("_acme-challenge.example.com.", "example.com.validation.example.net.")
+	s.SetCNAME("_acme-challenge.a.example.com.", "_acme-challenge.b.example.com.")
+	s.SetCNAME("_acme-challenge.b.example.com.", "_acme-challenge.a.example.com.")
+	for i := 0; i < MaxCNAMEChainLength+1; i++ {
+		s.SetCNAME(fmt.Sprintf("c%d.example.com.", i), fmt.Sprintf("c%d.example.com.", i+1))
+	}
+
+	addr := s.Addr
+
+	name, zone, err := ResolveChallengeTarget(context.TODO(), nil, addr, "_acme-challenge.Example.com")
+	if err != nil || name != "example.com.validation.example.net." || zone != "validation.example.net." {
+		t.Fatalf("unexpected result: %q %q %v", name, zone, err)
+	}
+
+	name, zone, err = ResolveChallengeTarget(context.TODO(), nil, addr, "_acme-challenge.www.example.com.")
+	if err != nil || name != "_acme-challenge.www.example.com." || zone != "example.com." {
+		t.Fatalf("unexpected result: %q %q %v", name, zone, err)
+	}
+
+	_, _, err = ResolveChallengeTarget(context.TODO(), nil, addr, "_acme-challenge.a.example.com.")
+	if err != ErrCNAMELoop {
+		t.Fatalf("expected loop error, got %v", err)
+	}
+
+	_, _, err = ResolveChallengeTarget(context.TODO(), nil, addr, "c1.example.com.")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	_, _, err = ResolveChallengeTarget(context.TODO(), nil, addr, "c0.example.com.")
+	if err != ErrCNAMEChainTooLong {
+		t.Fatalf("expected chain length error, got %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package acmeutils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Normalizes the IP address given, as is required for the value of an ACME
+// IP address identifier (RFC 8738). IPv4 addresses are returned in dotted
+// decimal form and IPv6 addresses in the canonical form specified by RFC
+// 5952. IPv4-mapped IPv6 addresses are returned in IPv4 form. If the IP
+// address is not valid, returns "" and an error.
+func NormalizeIP(ip string) (string, error) {
+	pip := net.ParseIP(ip)
+	if pip == nil {
+		return "", fmt.Errorf("invalid IP address: %#v", ip)
+	}
+
+	return pip.String(), nil
+}
+
+// Returns true iff the given string is a valid IP address.
+func ValidateIP(ip string) bool {
+	_, err := NormalizeIP(ip)
+	return err == nil
+}
+
+// Returns the reverse DNS name for the given IP address, in the in-addr.arpa
+// domain for IPv4 addresses and in the ip6.arpa domain for IPv6 addresses.
+// This is the name used in place of a hostname as the TLS SNI value when
+// validating IP address identifiers (RFC 8738).
+func ReverseDNSName(ip string) (string, error) {
+	pip := net.ParseIP(ip)
+	if pip == nil {
+		return "", fmt.Errorf("invalid IP address: %#v", ip)
+	}
+
+	if ip4 := pip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0]), nil
+	}
+
+	const hexDigits = "0123456789abcdef"
+	var b strings.Builder
+	for i := len(pip) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[pip[i]&0xF])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[pip[i]>>4])
+		b.WriteByte('.')
+	}
+
+	b.WriteString("ip6.arpa")
+	return b.String(), nil
+}
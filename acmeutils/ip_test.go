@@ -0,0 +1,39 @@
+package acmeutils
+
+import "testing"
+
+func TestIP(t *testing.T) {
+	type entry struct {
+		Input, Output, Reverse string
+		Valid                  bool
+	}
+
+	var entries = []entry{
+		{"192.0.2.1", "192.0.2.1", "1.2.0.192.in-addr.arpa", true},
+		{"::ffff:192.0.2.1", "192.0.2.1", "1.2.0.192.in-addr.arpa", true},
+		{"2001:DB8:0:0:0:0:0:1", "2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", true},
+		{"2001:db8::a:0:0:1", "2001:db8::a:0:0:1", "1.0.0.0.0.0.0.0.0.0.0.0.a.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", true},
+		{"192.0.2.256", "", "", false},
+		{"example.com", "", "", false},
+		{"[2001:db8::1]", "", "", false},
+	}
+
+	for _, e := range entries {
+		out, err := NormalizeIP(e.Input)
+		if e.Valid != (err == nil) || e.Valid != ValidateIP(e.Input) {
+			t.Logf("IP fail: expected valid=%v, got err=%v", e.Valid, err)
+			t.Fail()
+		}
+
+		if out != e.Output {
+			t.Logf("IP fail: for input %q, %q != %q", e.Input, out, e.Output)
+			t.Fail()
+		}
+
+		rev, _ := ReverseDNSName(e.Input)
+		if rev != e.Reverse {
+			t.Logf("IP fail: for input %q, reverse %q != %q", e.Input, rev, e.Reverse)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package acmeutils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/square/go-jose.v2"
+	"io"
+	"strings"
+)
+
+// Load a private key from a JSON Web Key. This is the form in which some
+// other ACME clients, such as certbot, store account keys. The key can be
+// RSA, ECDSA or Ed25519.
+func LoadPrivateKeyJWK(b []byte) (crypto.PrivateKey, error) {
+	var k jose.JSONWebKey
+	err := json.Unmarshal(b, &k)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JWK: %v", err)
+	}
+
+	if k.IsPublic() {
+		return nil, fmt.Errorf("JWK is not a private key")
+	}
+
+	if !k.Valid() {
+		return nil, fmt.Errorf("invalid JWK")
+	}
+
+	// go-jose does not check that the private and public parts of EC and
+	// Ed25519 keys belong together, so check this here to avoid loading a key
+	// which signs with a different public key to that which it reports.
+	switch pk := k.Key.(type) {
+	case *rsa.PrivateKey:
+		err = pk.Validate()
+		if err != nil {
+			return nil, err
+		}
+
+		pk.Precompute()
+		return pk, nil
+	case *ecdsa.PrivateKey:
+		if pk.D.Sign() <= 0 || pk.D.Cmp(pk.Curve.Params().N) >= 0 {
+			return nil, fmt.Errorf("invalid JWK: private key out of range")
+		}
+
+		x, y := pk.Curve.ScalarBaseMult(pk.D.Bytes())
+		if x.Cmp(pk.X) != 0 || y.Cmp(pk.Y) != 0 {
+			return nil, fmt.Errorf("invalid JWK: public key does not match private key")
+		}
+
+		return pk, nil
+	case ed25519.PrivateKey:
+		// go-jose zero-pads a short private key, so check its length in the
+		// original JSON.
+		var raw struct {
+			D string `json:"d"`
+		}
+		err = json.Unmarshal(b, &raw)
+		if err != nil {
+			return nil, err
+		}
+
+		seed, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(raw.D, "="))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid JWK: Ed25519 private key must be %d bytes", ed25519.SeedSize)
+		}
+
+		if !ed25519.NewKeyFromSeed(seed).Equal(pk) {
+			return nil, fmt.Errorf("invalid JWK: public key does not match private key")
+		}
+
+		return pk, nil
+	default:
+		return nil, fmt.Errorf("unsupported JWK key type: %T", k.Key)
+	}
+}
+
+// Write a private key as a JSON Web Key. The key can be RSA, ECDSA or
+// Ed25519.
+func SavePrivateKeyJWK(w io.Writer, pk crypto.PrivateKey) error {
+	switch pk.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+	default:
+		return fmt.Errorf("unsupported private key type: %T", pk)
+	}
+
+	b, err := json.Marshal(&jose.JSONWebKey{Key: pk})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// Returns the public key corresponding to a public or private key as a JSON
+// Web Key, in the form used for Account.Key. Any crypto.Signer may be passed
+// as a private key.
+func PublicKeyJWK(key interface{}) (*jose.JSONWebKey, error) {
+	if s, ok := key.(crypto.Signer); ok {
+		key = s.Public()
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported public key type: %T", key)
+	}
+
+	k := &jose.JSONWebKey{Key: key}
+	if !k.Valid() {
+		return nil, fmt.Errorf("invalid public key")
+	}
+
+	return k, nil
+}
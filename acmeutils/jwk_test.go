@@ -0,0 +1,159 @@
+package acmeutils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+)
+
+// From RFC 8037 Appendix A.1; the same key as testEdKey.
+const testEdKeyJWK = `{"kty":"OKP","crv":"Ed25519",
+"d":"nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A",
+"x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`
+
+type privateKey interface {
+	Public() crypto.PublicKey
+	Equal(crypto.PrivateKey) bool
+}
+
+func TestLoadPrivateKeyJWK(t *testing.T) {
+	pk, err := LoadPrivateKeyJWK([]byte(testEdKeyJWK))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ref, err := LoadPrivateKey([]byte(testEdKey))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if !ref.(privateKey).Equal(pk) {
+		t.Fatal()
+	}
+
+	_, err = LoadPrivateKeyJWK([]byte(`{"kty":"OKP","crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`))
+	if err == nil {
+		t.Fatal()
+	}
+
+	_, err = LoadPrivateKeyJWK([]byte(testEdKey))
+	if err == nil {
+		t.Fatal()
+	}
+
+	// Keys whose private and public parts do not match are rejected.
+	for _, s := range []string{
+		// Mismatched x.
+		`{"kty":"OKP","crv":"Ed25519","d":"nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A","x":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}`,
+		// Short d.
+		`{"kty":"OKP","crv":"Ed25519","d":"nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyu","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`,
+	} {
+		_, err = LoadPrivateKeyJWK([]byte(s))
+		if err == nil {
+			t.Fatalf("mismatched key loaded: %s", s)
+		}
+	}
+
+	// The public key of another key on the same curve.
+	ecKey, err := LoadPrivateKey([]byte(testECKey))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ecKey2, err := ecdsa.GenerateKey(ecKey.(*ecdsa.PrivateKey).Curve, rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var m, m2 map[string]interface{}
+	for _, x := range []struct {
+		Key interface{}
+		M   *map[string]interface{}
+	}{{ecKey, &m}, {ecKey2, &m2}} {
+		var buf bytes.Buffer
+		err = SavePrivateKeyJWK(&buf, x.Key)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		err = json.Unmarshal(buf.Bytes(), x.M)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	m["x"], m["y"] = m2["x"], m2["y"]
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	_, err = LoadPrivateKeyJWK(b)
+	if err == nil {
+		t.Fatalf("mismatched key loaded: %s", b)
+	}
+}
+
+func TestSavePrivateKeyJWK(t *testing.T) {
+	for _, s := range []string{testKey, testECKey, testEdKey} {
+		pk, err := LoadPrivateKey([]byte(s))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		var buf bytes.Buffer
+		err = SavePrivateKeyJWK(&buf, pk)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		pk2, err := LoadPrivateKeyJWK(buf.Bytes())
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		if !pk.(privateKey).Equal(pk2) {
+			t.Fatalf("mismatch after round trip: %s", buf.Bytes())
+		}
+
+		// The public JWK contains no private material and has the same
+		// thumbprint as the private key.
+		jwk, err := PublicKeyJWK(pk)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		if !jwk.IsPublic() {
+			t.Fatal()
+		}
+
+		b, err := json.Marshal(jwk)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		var m map[string]interface{}
+		err = json.Unmarshal(b, &m)
+		if err != nil || m["d"] != nil {
+			t.Fatalf("public JWK contains private key: %s", b)
+		}
+
+		tp1, err := Base64Thumbprint(pk)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		tp2, err := Base64Thumbprint(jwk.Key)
+		if err != nil || tp1 != tp2 {
+			t.Fatalf("thumbprint mismatch: %v", err)
+		}
+	}
+
+	err := SavePrivateKeyJWK(&bytes.Buffer{}, "foo")
+	if err == nil {
+		t.Fatal()
+	}
+}
@@ -10,15 +10,22 @@ import (
 	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/hex"
-	"gopkg.in/square/go-jose.v1"
+	"gopkg.in/square/go-jose.v2"
 	"math/big"
 	"time"
 )
 
 // Calculates the base64 thumbprint of a public or private key. Returns an
 // error if the key is of an unknown type.
+//
+// Any crypto.Signer may be passed as a private key, including signers for
+// keys held in hardware.
 func Base64Thumbprint(key interface{}) (string, error) {
-	k := jose.JsonWebKey{Key: key}
+	if s, ok := key.(crypto.Signer); ok {
+		key = s.Public()
+	}
+
+	k := jose.JSONWebKey{Key: key}
 	thumbprint, err := k.Thumbprint(crypto.SHA256)
 	if err != nil {
 		return "", err
@@ -51,6 +58,9 @@ func DNSKeyAuthorization(accountKey interface{}, token string) (string, error) {
 
 // Determines the hostname which must appear in a TLS-SNI challenge
 // certificate.
+//
+// Deprecated: The TLS-SNI challenge types are obsolete. Use TLS-ALPN-01 and
+// CreateTLSALPNCertificate instead.
 func TLSSNIHostname(accountKey interface{}, token string) (string, error) {
 	ka, err := KeyAuthorization(accountKey, token)
 	if err != nil {
@@ -64,6 +74,9 @@ func TLSSNIHostname(accountKey interface{}, token string) (string, error) {
 // Creates a self-signed certificate and matching private key suitable for
 // responding to a TLS-SNI challenge. hostname should be a hostname returned by
 // TLSSNIHostname.
+//
+// Deprecated: The TLS-SNI challenge types are obsolete. Use TLS-ALPN-01 and
+// CreateTLSALPNCertificate instead.
 func CreateTLSSNICertificate(hostname string) (certDER []byte, privateKey crypto.PrivateKey, err error) {
 	crt := x509.Certificate{
 		Subject: pkix.Name{
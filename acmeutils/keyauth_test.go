@@ -53,4 +53,19 @@ func TestKeyAuthorization(t *testing.T) {
 	if err != nil {
 		t.Fatal()
 	}
+
+	// Thumbprint from RFC 8037 Appendix A.3.
+	pk, err = LoadPrivateKey([]byte(testEdKey))
+	if err != nil {
+		t.Fatal()
+	}
+
+	ka, err = KeyAuthorization(pk, "foo")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if ka != "foo.kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k" {
+		t.Fatalf("%v", ka)
+	}
 }
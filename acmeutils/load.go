@@ -4,6 +4,7 @@ package acmeutils
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
@@ -50,8 +51,15 @@ func SaveCertificates(w io.Writer, certificates ...[]byte) error {
 	return nil
 }
 
-// Load a PEM private key from a stream.
+// Load a PEM private key from a stream. If the key is an encrypted PKCS8 key,
+// ErrPassphraseRequired is returned; use LoadPrivateKeyWithPassphrase to load
+// such keys.
 func LoadPrivateKey(keyPEMBlock []byte) (crypto.PrivateKey, error) {
+	return LoadPrivateKeyWithPassphrase(keyPEMBlock, nil)
+}
+
+// Returns the first private key PEM block in a stream.
+func decodePrivateKeyPEM(keyPEMBlock []byte) (*pem.Block, error) {
 	var keyDERBlock *pem.Block
 	for {
 		keyDERBlock, keyPEMBlock = pem.Decode(keyPEMBlock)
@@ -59,20 +67,13 @@ func LoadPrivateKey(keyPEMBlock []byte) (crypto.PrivateKey, error) {
 			return nil, fmt.Errorf("failed to parse key PEM data")
 		}
 		if keyDERBlock.Type == "PRIVATE KEY" || strings.HasSuffix(keyDERBlock.Type, " PRIVATE KEY") {
-			break
+			return keyDERBlock, nil
 		}
 	}
-
-	pk, err := LoadPrivateKeyDER(keyDERBlock.Bytes)
-	if err != nil {
-		return nil, err
-	}
-
-	return pk, nil
 }
 
-// Parse a DER private key. The key can be RSA or ECDSA. PKCS8 containers are
-// supported.
+// Parse a DER private key. The key can be RSA, ECDSA or Ed25519. PKCS8
+// containers are supported, and are required for Ed25519 keys.
 func LoadPrivateKeyDER(der []byte) (crypto.PrivateKey, error) {
 	pk, err := x509.ParsePKCS1PrivateKey(der)
 	if err == nil {
@@ -82,7 +83,7 @@ func LoadPrivateKeyDER(der []byte) (crypto.PrivateKey, error) {
 	pk2, err := x509.ParsePKCS8PrivateKey(der)
 	if err == nil {
 		switch pk2 := pk2.(type) {
-		case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
 			return pk2, nil
 		default:
 			return nil, fmt.Errorf("unknown private key type")
@@ -97,7 +98,10 @@ func LoadPrivateKeyDER(der []byte) (crypto.PrivateKey, error) {
 	return nil, fmt.Errorf("failed to parse private key")
 }
 
-// Write a private key in PEM form.
+// Write a private key in PEM form. RSA and ECDSA keys are written in PKCS1 and
+// SEC1 form respectively; Ed25519 keys, which have no other standard
+// encoding, are written in PKCS8 form. The key is not encrypted; see
+// SavePrivateKeyEncrypted.
 func SavePrivateKey(w io.Writer, pk crypto.PrivateKey) error {
 	var kb []byte
 	var hdr string
@@ -110,6 +114,9 @@ func SavePrivateKey(w io.Writer, pk crypto.PrivateKey) error {
 	case *ecdsa.PrivateKey:
 		kb, err = x509.MarshalECPrivateKey(v)
 		hdr = "EC PRIVATE KEY"
+	case ed25519.PrivateKey:
+		kb, err = x509.MarshalPKCS8PrivateKey(v)
+		hdr = "PRIVATE KEY"
 	default:
 		return fmt.Errorf("unsupported private key type: %T", pk)
 	}
@@ -0,0 +1,501 @@
+package acmeutils
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+	"hash"
+	"io"
+)
+
+// Returned when loading an encrypted private key without a passphrase.
+var ErrPassphraseRequired = errors.New("private key is encrypted and no passphrase was provided")
+
+// Returned when an encrypted private key cannot be decrypted with the given
+// passphrase.
+var ErrIncorrectPassphrase = errors.New("incorrect passphrase for private key")
+
+// Called to obtain the passphrase for an encrypted private key, for example by
+// prompting the user.
+type PassphraseFunc func() ([]byte, error)
+
+// Controls how SavePrivateKeyEncrypted encrypts a private key. The zero value
+// uses PBKDF2 with HMAC-SHA256 and AES-256-CBC, which is widely supported,
+// including by OpenSSL.
+type EncryptionOptions struct {
+	// If true, scrypt is used rather than PBKDF2 to derive the encryption key
+	// from the passphrase. scrypt is more resistant to brute force attacks.
+	Scrypt bool
+
+	// If true, AES-256-GCM is used rather than AES-256-CBC. Note that OpenSSL
+	// cannot decrypt keys encrypted using GCM.
+	GCM bool
+
+	// The PBKDF2 iteration count (default 600000, maximum 10000000), or the
+	// scrypt cost parameter N (default 16384, maximum 1048576), which must be a
+	// power of two.
+	Cost int
+}
+
+// Returns the cost parameter to be used, or an error if it exceeds the limits
+// accepted when decrypting keys.
+func (opts *EncryptionOptions) cost() (int, error) {
+	if opts.Scrypt {
+		n := opts.Cost
+		if n == 0 {
+			n = defaultScryptN
+		}
+		if n < 2 || n&(n-1) != 0 || n > maxScryptMemory/128/scryptR {
+			return 0, fmt.Errorf("invalid scrypt cost parameter: %d", n)
+		}
+
+		return n, nil
+	}
+
+	iter := opts.Cost
+	if iter == 0 {
+		iter = defaultPBKDF2Iterations
+	}
+	if iter < 1 || iter > maxPBKDF2Iterations {
+		return 0, fmt.Errorf("invalid PBKDF2 iteration count: %d", iter)
+	}
+
+	return iter, nil
+}
+
+const (
+	defaultPBKDF2Iterations = 600000
+	defaultScryptN          = 16384
+	scryptR                 = 8
+	scryptP                 = 1
+
+	// Limits on the parameters accepted when decrypting keys, so that a
+	// malicious key file cannot consume unbounded resources.
+	maxPBKDF2Iterations  = 10000000
+	maxScryptMemory      = 1 << 30
+	maxScryptParallelism = 16
+)
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidAES128GCM      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 6}
+	oidAES192GCM      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 26}
+	oidAES256GCM      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 46}
+)
+
+// PKCS#8 EncryptedPrivateKeyInfo (RFC 5958).
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// PBES2-params (RFC 8018).
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// PBKDF2-params (RFC 8018). The PRF defaults to HMAC-SHA1 if absent.
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// scrypt-params (RFC 7914).
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+// GCMParameters (RFC 5084).
+type gcmParams struct {
+	Nonce  []byte
+	ICVLen int `asn1:"optional,default:12"`
+}
+
+// Load a PEM private key from a stream, decrypting it if it is an encrypted
+// PKCS8 key. passphrase is called to obtain the passphrase only if the key is
+// encrypted; if it is nil, ErrPassphraseRequired is returned for encrypted
+// keys.
+func LoadPrivateKeyWithPassphrase(keyPEMBlock []byte, passphrase PassphraseFunc) (crypto.PrivateKey, error) {
+	keyDERBlock, err := decodePrivateKeyPEM(keyPEMBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	if keyDERBlock.Type != "ENCRYPTED PRIVATE KEY" {
+		return LoadPrivateKeyDER(keyDERBlock.Bytes)
+	}
+
+	if passphrase == nil {
+		return nil, ErrPassphraseRequired
+	}
+
+	pw, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := decryptPKCS8(keyDERBlock.Bytes, pw)
+	if err != nil {
+		return nil, err
+	}
+
+	pk, err := LoadPrivateKeyDER(der)
+	if err != nil {
+		// With CBC, an incorrect passphrase will usually be detected as a
+		// padding error, but may occasionally yield garbage instead.
+		return nil, ErrIncorrectPassphrase
+	}
+
+	return pk, nil
+}
+
+// Write a private key in PEM form as an encrypted PKCS8 key, encrypted using
+// the given passphrase. If opts is nil, default options are used.
+func SavePrivateKeyEncrypted(w io.Writer, pk crypto.PrivateKey, passphrase []byte, opts *EncryptionOptions) error {
+	if opts == nil {
+		opts = &EncryptionOptions{}
+	}
+
+	// Check the options before writing anything, as a key encrypted with
+	// parameters which LoadPrivateKeyWithPassphrase rejects would be lost.
+	_, err := opts.cost()
+	if err != nil {
+		return err
+	}
+
+	kb, err := x509.MarshalPKCS8PrivateKey(pk)
+	if err != nil {
+		return err
+	}
+
+	eb, err := encryptPKCS8(kb, passphrase, opts)
+	if err != nil {
+		return err
+	}
+
+	return pem.Encode(w, &pem.Block{
+		Type:  "ENCRYPTED PRIVATE KEY",
+		Bytes: eb,
+	})
+}
+
+// Encrypts a DER-encoded PKCS8 private key using PBES2, returning a
+// DER-encoded EncryptedPrivateKeyInfo.
+func encryptPKCS8(der, passphrase []byte, opts *EncryptionOptions) ([]byte, error) {
+	cost, err := opts.cost()
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	_, err = io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	var kdf pkix.AlgorithmIdentifier
+	if opts.Scrypt {
+		key, err = scrypt.Key(passphrase, salt, cost, scryptR, scryptP, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		kdf, err = newAlgorithmIdentifier(oidScrypt, scryptParams{
+			Salt:                     salt,
+			CostParameter:            cost,
+			BlockSize:                scryptR,
+			ParallelizationParameter: scryptP,
+			KeyLength:                32,
+		})
+	} else {
+		key = pbkdf2.Key(passphrase, salt, cost, 32, sha256.New)
+		kdf, err = newAlgorithmIdentifier(oidPBKDF2, pbkdf2Params{
+			Salt:           salt,
+			IterationCount: cost,
+			KeyLength:      32,
+			PRF: pkix.AlgorithmIdentifier{
+				Algorithm:  oidHMACWithSHA256,
+				Parameters: asn1.NullRawValue,
+			},
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var ciphertext []byte
+	var enc pkix.AlgorithmIdentifier
+	if opts.GCM {
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		nonce := make([]byte, aead.NonceSize())
+		_, err = io.ReadFull(rand.Reader, nonce)
+		if err != nil {
+			return nil, err
+		}
+
+		ciphertext = aead.Seal(nil, nonce, der, nil)
+		enc, err = newAlgorithmIdentifier(oidAES256GCM, gcmParams{
+			Nonce:  nonce,
+			ICVLen: aead.Overhead(),
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		iv := make([]byte, aes.BlockSize)
+		_, err = io.ReadFull(rand.Reader, iv)
+		if err != nil {
+			return nil, err
+		}
+
+		// PKCS#7 padding.
+		n := aes.BlockSize - len(der)%aes.BlockSize
+		ciphertext = make([]byte, len(der)+n)
+		copy(ciphertext, der)
+		for i := len(der); i < len(ciphertext); i++ {
+			ciphertext[i] = byte(n)
+		}
+
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+		enc, err = newAlgorithmIdentifier(oidAES256CBC, iv)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	alg, err := newAlgorithmIdentifier(oidPBES2, pbes2Params{
+		KeyDerivationFunc: kdf,
+		EncryptionScheme:  enc,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     alg,
+		EncryptedData: ciphertext,
+	})
+}
+
+// Decrypts a DER-encoded EncryptedPrivateKeyInfo which uses PBES2, returning
+// the DER-encoded PKCS8 private key.
+func decryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	err := unmarshalDER(der, &info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse encrypted private key: %v", err)
+	}
+
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported private key encryption algorithm: %v", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	err = unmarshalDER(info.Algorithm.Parameters.FullBytes, &params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PBES2 parameters: %v", err)
+	}
+
+	enc := params.EncryptionScheme.Algorithm
+	var keyLen int
+	var isGCM bool
+	switch {
+	case enc.Equal(oidAES128CBC):
+		keyLen = 16
+	case enc.Equal(oidAES192CBC):
+		keyLen = 24
+	case enc.Equal(oidAES256CBC):
+		keyLen = 32
+	case enc.Equal(oidAES128GCM):
+		keyLen, isGCM = 16, true
+	case enc.Equal(oidAES192GCM):
+		keyLen, isGCM = 24, true
+	case enc.Equal(oidAES256GCM):
+		keyLen, isGCM = 32, true
+	default:
+		return nil, fmt.Errorf("unsupported private key encryption scheme: %v", enc)
+	}
+
+	key, err := deriveKey(params.KeyDerivationFunc, passphrase, keyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if isGCM {
+		var gp gcmParams
+		err = unmarshalDER(params.EncryptionScheme.Parameters.FullBytes, &gp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse GCM parameters: %v", err)
+		}
+
+		if gp.ICVLen < 12 || gp.ICVLen > 16 {
+			return nil, fmt.Errorf("unsupported GCM tag length: %d", gp.ICVLen)
+		}
+
+		aead, err := cipher.NewGCMWithTagSize(block, gp.ICVLen)
+		if err != nil {
+			return nil, err
+		}
+		if len(gp.Nonce) != aead.NonceSize() {
+			return nil, fmt.Errorf("unsupported GCM nonce length: %d", len(gp.Nonce))
+		}
+
+		pt, err := aead.Open(nil, gp.Nonce, info.EncryptedData, nil)
+		if err != nil {
+			return nil, ErrIncorrectPassphrase
+		}
+
+		return pt, nil
+	}
+
+	var iv []byte
+	_, err = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv)
+	if err != nil || len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid CBC initialization vector")
+	}
+
+	ct := info.EncryptedData
+	if len(ct) == 0 || len(ct)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid encrypted private key length")
+	}
+
+	pt := make([]byte, len(ct))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(pt, ct)
+
+	// Remove PKCS#7 padding.
+	n := int(pt[len(pt)-1])
+	if n == 0 || n > aes.BlockSize {
+		return nil, ErrIncorrectPassphrase
+	}
+	for _, b := range pt[len(pt)-n:] {
+		if int(b) != n {
+			return nil, ErrIncorrectPassphrase
+		}
+	}
+
+	return pt[:len(pt)-n], nil
+}
+
+// Derives an encryption key of the given length from a passphrase using the
+// PBES2 key derivation function described by kdf.
+func deriveKey(kdf pkix.AlgorithmIdentifier, passphrase []byte, keyLen int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var p pbkdf2Params
+		err := unmarshalDER(kdf.Parameters.FullBytes, &p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse PBKDF2 parameters: %v", err)
+		}
+
+		if p.KeyLength != 0 && p.KeyLength != keyLen {
+			return nil, fmt.Errorf("PBKDF2 key length does not match encryption scheme")
+		}
+		if p.IterationCount < 1 || p.IterationCount > maxPBKDF2Iterations {
+			return nil, fmt.Errorf("unsupported PBKDF2 iteration count: %d", p.IterationCount)
+		}
+
+		var h func() hash.Hash
+		switch prf := p.PRF.Algorithm; {
+		case len(prf) == 0 || prf.Equal(oidHMACWithSHA1):
+			h = sha1.New
+		case prf.Equal(oidHMACWithSHA256):
+			h = sha256.New
+		case prf.Equal(oidHMACWithSHA384):
+			h = sha512.New384
+		case prf.Equal(oidHMACWithSHA512):
+			h = sha512.New
+		default:
+			return nil, fmt.Errorf("unsupported PBKDF2 PRF: %v", prf)
+		}
+
+		return pbkdf2.Key(passphrase, p.Salt, p.IterationCount, keyLen, h), nil
+
+	case kdf.Algorithm.Equal(oidScrypt):
+		var p scryptParams
+		err := unmarshalDER(kdf.Parameters.FullBytes, &p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse scrypt parameters: %v", err)
+		}
+
+		if p.KeyLength != 0 && p.KeyLength != keyLen {
+			return nil, fmt.Errorf("scrypt key length does not match encryption scheme")
+		}
+		if p.CostParameter < 2 || p.BlockSize < 1 || p.ParallelizationParameter < 1 ||
+			p.CostParameter > maxScryptMemory/128/p.BlockSize || p.ParallelizationParameter > maxScryptParallelism {
+			return nil, fmt.Errorf("unsupported scrypt parameters")
+		}
+
+		return scrypt.Key(passphrase, p.Salt, p.CostParameter, p.BlockSize, p.ParallelizationParameter, keyLen)
+
+	default:
+		return nil, fmt.Errorf("unsupported key derivation function: %v", kdf.Algorithm)
+	}
+}
+
+func newAlgorithmIdentifier(oid asn1.ObjectIdentifier, params interface{}) (pkix.AlgorithmIdentifier, error) {
+	b, err := asn1.Marshal(params)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+
+	return pkix.AlgorithmIdentifier{
+		Algorithm:  oid,
+		Parameters: asn1.RawValue{FullBytes: b},
+	}, nil
+}
+
+// Like asn1.Unmarshal, but fails if there is trailing data.
+func unmarshalDER(b []byte, v interface{}) error {
+	rest, err := asn1.Unmarshal(b, v)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("trailing data")
+	}
+
+	return nil
+}
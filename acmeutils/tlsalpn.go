@@ -0,0 +1,183 @@
+package acmeutils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The ALPN protocol name used for TLS-ALPN-01 challenges (RFC 8737). A TLS
+// server answering such challenges must advertise this protocol.
+const ACMETLS1Protocol = "acme-tls/1"
+
+// OID of the id-pe-acmeIdentifier X.509 extension.
+var oidACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// Creates a self-signed certificate and matching private key suitable for
+// responding to a TLS-ALPN-01 challenge for the given identifier, which may be
+// a hostname or an IP address. The certificate contains the identifier as its
+// only subjectAltName and a critical acmeIdentifier extension containing the
+// SHA-256 hash of the key authorization.
+func CreateTLSALPNCertificate(accountKey interface{}, token, identifier string) (certDER []byte, privateKey crypto.PrivateKey, err error) {
+	ka, err := KeyAuthorization(accountKey, token)
+	if err != nil {
+		return
+	}
+
+	extValue, err := asn1.Marshal(sha256Bytes([]byte(ka)))
+	if err != nil {
+		return
+	}
+
+	crt := x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: "ACME TLS-ALPN-01 Challenge Certificate",
+		},
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(7 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		ExtraExtensions: []pkix.Extension{
+			{
+				Id:       oidACMEIdentifier,
+				Critical: true,
+				Value:    extValue,
+			},
+		},
+	}
+
+	if ip := net.ParseIP(identifier); ip != nil {
+		crt.IPAddresses = []net.IP{ip}
+	} else {
+		crt.DNSNames = []string{identifier}
+	}
+
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+
+	certDER, err = x509.CreateCertificate(rand.Reader, &crt, &crt, &pk.PublicKey, pk)
+	privateKey = pk
+	return
+}
+
+// Returns the TLS server name (SNI value) which will be used by a validation
+// server connecting to respond to a TLS-ALPN-01 challenge for the given
+// identifier. For hostnames this is the hostname itself; for IP addresses
+// it is the reverse DNS name of the address (RFC 8738).
+func TLSALPNServerName(identifier string) (string, error) {
+	if ValidateIP(identifier) {
+		return ReverseDNSName(identifier)
+	}
+
+	return NormalizeHostname(identifier)
+}
+
+// Answers TLS-ALPN-01 challenges for registered identifiers. It is safe for
+// concurrent use.
+//
+// Use GetCertificate as the GetCertificate function of a TLS server, and make
+// sure that the server advertises ACMETLS1Protocol in its NextProtos, or use
+// TLSConfig to obtain a suitable configuration.
+type TLSALPNResponder struct {
+	// Optional. Called by GetCertificate for handshakes which are not
+	// TLS-ALPN-01 validation handshakes. This allows the responder to be used
+	// on a TLS server which also serves normal traffic. If this is nil, such
+	// handshakes fail.
+	Fallback func(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	mutex sync.RWMutex
+	certs map[string]*tls.Certificate
+}
+
+// Starts answering TLS-ALPN-01 challenges for the given identifier (a
+// hostname or an IP address) using the given account key and challenge token.
+// Any challenge previously registered for the identifier is replaced.
+func (r *TLSALPNResponder) Add(accountKey interface{}, token, identifier string) error {
+	serverName, err := TLSALPNServerName(identifier)
+	if err != nil {
+		return err
+	}
+
+	certDER, pk, err := CreateTLSALPNCertificate(accountKey, token, identifier)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.certs == nil {
+		r.certs = map[string]*tls.Certificate{}
+	}
+
+	r.certs[serverName] = &tls.Certificate{
+		Certificate: [][]byte{certDER},
+		PrivateKey:  pk,
+	}
+	return nil
+}
+
+// Stops answering TLS-ALPN-01 challenges for the given identifier.
+func (r *TLSALPNResponder) Remove(identifier string) {
+	serverName, err := TLSALPNServerName(identifier)
+	if err != nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.certs, serverName)
+}
+
+// Suitable for use as the GetCertificate function of a tls.Config.
+func (r *TLSALPNResponder) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !isACMETLS1Hello(hello) {
+		if r.Fallback != nil {
+			return r.Fallback(hello)
+		}
+
+		return nil, fmt.Errorf("not a TLS-ALPN-01 validation handshake")
+	}
+
+	serverName := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	crt, ok := r.certs[serverName]
+	if !ok {
+		return nil, fmt.Errorf("no TLS-ALPN-01 challenge registered for %q", serverName)
+	}
+
+	return crt, nil
+}
+
+// Returns a TLS configuration which answers TLS-ALPN-01 challenges using the
+// responder. The configuration can be modified as desired, but
+// ACMETLS1Protocol must remain in NextProtos.
+func (r *TLSALPNResponder) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		NextProtos:     []string{ACMETLS1Protocol},
+	}
+}
+
+func isACMETLS1Hello(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == ACMETLS1Protocol
+}
@@ -0,0 +1,137 @@
+package acmeutils
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"net"
+	"testing"
+)
+
+func TestTLSALPNCertificate(t *testing.T) {
+	pk, err := LoadPrivateKey([]byte(testECKey))
+	if err != nil {
+		t.Fatal()
+	}
+
+	ka, err := KeyAuthorization(pk, "foo")
+	if err != nil {
+		t.Fatal()
+	}
+
+	certDER, _, err := CreateTLSALPNCertificate(pk, "foo", "example.com")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	crt, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if len(crt.DNSNames) != 1 || crt.DNSNames[0] != "example.com" || len(crt.IPAddresses) != 0 {
+		t.Fatalf("unexpected SANs: %v %v", crt.DNSNames, crt.IPAddresses)
+	}
+
+	checkACMEIdentifier(t, crt, sha256Bytes([]byte(ka)))
+
+	certDER, _, err = CreateTLSALPNCertificate(pk, "foo", "2001:db8::1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	crt, err = x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if len(crt.DNSNames) != 0 || len(crt.IPAddresses) != 1 || crt.IPAddresses[0].String() != "2001:db8::1" {
+		t.Fatalf("unexpected SANs: %v %v", crt.DNSNames, crt.IPAddresses)
+	}
+}
+
+func checkACMEIdentifier(t *testing.T, crt *x509.Certificate, expected []byte) {
+	for _, ext := range crt.Extensions {
+		if !ext.Id.Equal(oidACMEIdentifier) {
+			continue
+		}
+
+		if !ext.Critical {
+			t.Fatalf("acmeIdentifier extension is not critical")
+		}
+
+		var v []byte
+		rest, err := asn1.Unmarshal(ext.Value, &v)
+		if err != nil || len(rest) != 0 || !bytes.Equal(v, expected) {
+			t.Fatalf("acmeIdentifier extension has wrong value")
+		}
+
+		return
+	}
+
+	t.Fatalf("acmeIdentifier extension not found")
+}
+
+func TestTLSALPNResponder(t *testing.T) {
+	pk, err := LoadPrivateKey([]byte(testECKey))
+	if err != nil {
+		t.Fatal()
+	}
+
+	ka, err := KeyAuthorization(pk, "foo")
+	if err != nil {
+		t.Fatal()
+	}
+
+	r := &TLSALPNResponder{}
+	err = r.Add(pk, "foo", "192.0.2.1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	handshake := func(serverName string, protos []string) (*tls.ConnectionState, error) {
+		c, s := net.Pipe()
+		defer c.Close()
+
+		go func() {
+			defer s.Close()
+			tls.Server(s, r.TLSConfig()).Handshake()
+		}()
+
+		cc := tls.Client(c, &tls.Config{
+			ServerName:         serverName,
+			NextProtos:         protos,
+			InsecureSkipVerify: true,
+		})
+		err := cc.Handshake()
+		if err != nil {
+			return nil, err
+		}
+
+		cs := cc.ConnectionState()
+		return &cs, nil
+	}
+
+	cs, err := handshake("1.2.0.192.in-addr.arpa", []string{ACMETLS1Protocol})
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	if cs.NegotiatedProtocol != ACMETLS1Protocol {
+		t.Fatalf("unexpected protocol: %q", cs.NegotiatedProtocol)
+	}
+
+	checkACMEIdentifier(t, cs.PeerCertificates[0], sha256Bytes([]byte(ka)))
+
+	_, err = handshake("1.2.0.192.in-addr.arpa", []string{"h2"})
+	if err == nil {
+		t.Fatalf("non-validation handshake succeeded without fallback")
+	}
+
+	r.Remove("192.0.2.1")
+	_, err = handshake("1.2.0.192.in-addr.arpa", []string{ACMETLS1Protocol})
+	if err == nil {
+		t.Fatalf("handshake succeeded after removal")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	denet "github.com/hlandau/goutils/net"
 	"gopkg.in/hlandau/acmeapi.v2/acmeutils"
+	"gopkg.in/square/go-jose.v2"
 	"io/ioutil"
 	"mime"
 	"net/http"
@@ -19,8 +20,15 @@ type postAccount struct {
 	ContactURIs          []string      `json:"contact,omitempty"`
 	Status               AccountStatus `json:"status,omitempty"`
 	OnlyReturnExisting   bool          `json:"onlyReturnExisting,omitempty"`
+
+	ExternalAccountBinding json.RawMessage `json:"externalAccountBinding,omitempty"`
 }
 
+// Error returned when registering an account with a realm which requires
+// external account binding without providing external account binding
+// credentials.
+var ErrExternalAccountRequired = errors.New("realm requires external account binding but no credentials were provided")
+
 func (c *RealmClient) postAccount(ctx context.Context, acct *Account, onlyReturnExisting bool) error {
 	postAcct := &postAccount{
 		ContactURIs:          acct.ContactURIs,
@@ -44,6 +52,17 @@ func (c *RealmClient) postAccount(ctx context.Context, acct *Account, onlyReturn
 		endp = di.NewAccount
 		expectCode = newAccountCodes
 		updating = false
+
+		if !onlyReturnExisting {
+			if acct.ExternalAccountBinding != nil {
+				postAcct.ExternalAccountBinding, err = acct.ExternalAccountBinding.sign(acct.PrivateKey, endp)
+				if err != nil {
+					return err
+				}
+			} else if di.Meta.ExternalAccountRequired {
+				return ErrExternalAccountRequired
+			}
+		}
 	}
 
 	acctU := acct
@@ -51,7 +70,20 @@ func (c *RealmClient) postAccount(ctx context.Context, acct *Account, onlyReturn
 		acctU = &noAccountNeeded
 	}
 
+	creating := !updating && !onlyReturnExisting
+	var limitTime time.Time
+	if creating {
+		var err error
+		limitTime, err = c.cfg.RateLimiter.waitNewAccount(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
 	res, err := c.doReq(ctx, "POST", endp, acctU, acct.PrivateKey, postAcct, acct)
+	if creating {
+		c.cfg.RateLimiter.done(newAccountLimitKey, limitTime, err)
+	}
 	if res == nil {
 		return err
 	}
@@ -95,6 +127,11 @@ func (c *RealmClient) registerAccount(ctx context.Context, acct *Account, onlyRe
 // TermsOfServiceAgreed field and the Status field. The Status field is only sent
 // if it is set to AccountDeactivated ("deactivated"); no other transition can be
 // manually requested by the client.
+//
+// If acct.ExternalAccountBinding is set, the account is bound to the external
+// account it identifies. If the realm requires external account binding and
+// it is not set, ErrExternalAccountRequired is returned without making a
+// registration request.
 func (c *RealmClient) RegisterAccount(ctx context.Context, acct *Account) error {
 	return c.registerAccount(ctx, acct, false)
 }
@@ -146,6 +183,7 @@ func (c *RealmClient) LoadAuthorization(ctx context.Context, acct *Account, az *
 		return err
 	}
 
+	c.cfg.RateLimiter.noteAuthorization(acct, az)
 	az.retryAt = retryAtDefault(res.Header, defaultPollTime)
 	return nil
 }
@@ -164,6 +202,102 @@ func (c *RealmClient) WaitLoadAuthorization(ctx context.Context, acct *Account,
 	return c.LoadAuthorization(ctx, acct, az)
 }
 
+// Wait for an authorization to reach a final state. Only the URL is required
+// to be set. Returns nil if the authorization becomes valid; otherwise, an
+// error of type *ValidationError is returned.
+func (c *RealmClient) WaitForAuthorization(ctx context.Context, acct *Account, az *Authorization) error {
+	for az.Status == "" || !az.Status.IsFinal() {
+		err := c.WaitLoadAuthorization(ctx, acct, az)
+		if err != nil {
+			return err
+		}
+	}
+
+	if az.Status == AuthorizationValid {
+		return nil
+	}
+
+	ve := &ValidationError{
+		Authorization: az,
+	}
+
+	for i := range az.Challenges {
+		if az.Challenges[i].Status == ChallengeInvalid {
+			ve.Challenge = &az.Challenges[i]
+			ve.Problem = az.Challenges[i].Error
+			break
+		}
+	}
+
+	return ve
+}
+
+type deactivateAuthorizationReq struct {
+	Status AuthorizationStatus `json:"status"`
+}
+
+// Deactivates an authorization. Only the URL of az is required to be set. On
+// success, az is updated with the authorization returned by the server,
+// whose status is AuthorizationDeactivated.
+//
+// Deactivation relinquishes the account's authorization for the identifier,
+// so that the account can no longer obtain certificates for it without
+// completing a new authorization.
+func (c *RealmClient) DeactivateAuthorization(ctx context.Context, acct *Account, az *Authorization) error {
+	req := &deactivateAuthorizationReq{
+		Status: AuthorizationDeactivated,
+	}
+
+	res, err := c.doReq(ctx, "POST", az.URL, acct, nil, req, az)
+	if err != nil {
+		return err
+	}
+
+	err = az.validate()
+	if err != nil {
+		return err
+	}
+
+	az.retryAt = retryAtDefault(res.Header, defaultPollTime)
+
+	if az.Status != AuthorizationDeactivated {
+		return fmt.Errorf("authorization has status %q after deactivation", az.Status)
+	}
+
+	return nil
+}
+
+// Deactivates all pending or valid authorizations of an order. The order
+// must have been loaded. Authorizations which are already in another state
+// are left alone. The authorizations are loaded to determine their state,
+// and the deactivated authorizations are returned.
+//
+// If an error occurs, the authorizations deactivated so far are returned
+// along with the error.
+func (c *RealmClient) DeactivateOrderAuthorizations(ctx context.Context, acct *Account, order *Order) ([]*Authorization, error) {
+	var deactivated []*Authorization
+	for _, u := range order.AuthorizationURLs {
+		az := &Authorization{URL: u}
+		err := c.LoadAuthorization(ctx, acct, az)
+		if err != nil {
+			return deactivated, err
+		}
+
+		if az.Status != AuthorizationPending && az.Status != AuthorizationValid {
+			continue
+		}
+
+		err = c.DeactivateAuthorization(ctx, acct, az)
+		if err != nil {
+			return deactivated, err
+		}
+
+		deactivated = append(deactivated, az)
+	}
+
+	return deactivated, nil
+}
+
 func (az *Authorization) validate() error {
 	if len(az.Challenges) == 0 {
 		return errors.New("no challenges offered")
@@ -209,6 +343,7 @@ func (c *RealmClient) NewAuthorization(ctx context.Context, acct *Account, ident
 		return nil, err
 	}
 
+	c.cfg.RateLimiter.noteAuthorization(acct, az)
 	return az, nil
 }
 
@@ -216,21 +351,33 @@ type postOrder struct {
 	Identifiers []Identifier `json:"identifiers,omitempty"`
 	NotBefore   *time.Time   `json:"notBefore,omitempty"`
 	NotAfter    *time.Time   `json:"notAfter,omitempty"`
+	Replaces    string       `json:"replaces,omitempty"`
+	Profile     string       `json:"profile,omitempty"`
 }
 
 // Creates a new order. You must set at least the Identifiers field of Order.
-// The NotBefore and NotAfter fields may also optionally be set. The other
-// fields, including URI, will be filled in when the method returns.
+// The NotBefore, NotAfter, Replaces and Profile fields may also optionally be
+// set. The other fields, including URI, will be filled in when the method
+// returns.
+//
+// If a profile is specified which the realm does not offer, an error is
+// returned without making a request.
 func (c *RealmClient) NewOrder(ctx context.Context, acct *Account, order *Order) error {
 	di, err := c.getDirectory(ctx)
 	if err != nil {
 		return err
 	}
 
+	if order.Profile != "" && !di.Meta.HasProfile(order.Profile) {
+		return fmt.Errorf("certificate profile not offered by realm: %q", order.Profile)
+	}
+
 	po := &postOrder{
 		Identifiers: order.Identifiers,
 		NotBefore:   &order.NotBefore,
 		NotAfter:    &order.NotAfter,
+		Replaces:    order.Replaces,
+		Profile:     order.Profile,
 	}
 	if po.NotBefore.IsZero() {
 		po.NotBefore = nil
@@ -239,7 +386,13 @@ func (c *RealmClient) NewOrder(ctx context.Context, acct *Account, order *Order)
 		po.NotAfter = nil
 	}
 
+	limitTime, err := c.cfg.RateLimiter.waitNewOrder(ctx, acct, order.Identifiers)
+	if err != nil {
+		return err
+	}
+
 	res, err := c.doReq(ctx, "POST", di.NewOrder, acct, nil, po, order)
+	c.cfg.RateLimiter.done(newOrderLimitKey(acct), limitTime, err)
 	if err != nil {
 		return err
 	}
@@ -308,6 +461,49 @@ func (c *RealmClient) WaitForOrder(ctx context.Context, acct *Account, order *Or
 	}
 }
 
+type ordersList struct {
+	Orders []string `json:"orders"`
+}
+
+// Lists the URLs of the orders associated with an account. acct.URL and
+// acct.OrdersURL must be set; OrdersURL is filled in when an account is
+// registered, located or updated.
+//
+// If the server paginates the list, all pages are retrieved. Servers may
+// omit orders which are no longer pending or otherwise of interest from the
+// list. Use LoadOrder to load each order.
+func (c *RealmClient) ListOrders(ctx context.Context, acct *Account) ([]string, error) {
+	if acct.OrdersURL == "" {
+		return nil, fmt.Errorf("account orders URL is unknown")
+	}
+
+	var orderURLs []string
+	seen := map[string]struct{}{}
+	for u := acct.OrdersURL; u != ""; {
+		if _, ok := seen[u]; ok {
+			return nil, fmt.Errorf("order list pagination loop detected: %q", u)
+		}
+		seen[u] = struct{}{}
+
+		var ol ordersList
+		// POST-as-GET.
+		res, err := c.doReq(ctx, "POST", u, acct, nil, "", &ol)
+		if err != nil {
+			return nil, err
+		}
+
+		orderURLs = append(orderURLs, ol.Orders...)
+
+		next := linksByRel(res.Header, "next", u)
+		u = ""
+		if len(next) > 0 {
+			u = next[0]
+		}
+	}
+
+	return orderURLs, nil
+}
+
 func (c *RealmClient) LoadCertificate(ctx context.Context, acct *Account, cert *Certificate) error {
 	// Check input.
 	if !ValidURL(cert.URL) {
@@ -341,9 +537,36 @@ func (c *RealmClient) LoadCertificate(ctx context.Context, acct *Account, cert *
 		return err
 	}
 
+	cert.AlternateURLs = linksByRel(res.Header, "alternate", cert.URL)
 	return nil
 }
 
+// Loads a certificate and all alternate chains offered for it. Only the URL
+// of cert is required to be set; cert is loaded as with LoadCertificate and
+// is returned as the first element of the returned slice, followed by one
+// Certificate for each alternate chain, in the order offered by the server.
+//
+// See SelectChain for choosing between the returned chains.
+func (c *RealmClient) LoadCertificateChains(ctx context.Context, acct *Account, cert *Certificate) ([]*Certificate, error) {
+	err := c.LoadCertificate(ctx, acct, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	chains := []*Certificate{cert}
+	for _, u := range cert.AlternateURLs {
+		alt := &Certificate{URL: u}
+		err := c.LoadCertificate(ctx, acct, alt)
+		if err != nil {
+			return nil, err
+		}
+
+		chains = append(chains, alt)
+	}
+
+	return chains, nil
+}
+
 // This is a rather kludgy method needed for backwards compatibility with
 // old-ACME URLs. If it is not known whether an URL is to a certificate or an
 // order, this method can be used to load the URL. Returns with isCertificate
@@ -397,6 +620,7 @@ func (c *RealmClient) LoadOrderOrCertificate(ctx context.Context, url string, ac
 		b, err = ioutil.ReadAll(denet.LimitReader(res.Body, 512*1024))
 		cert.URL = url
 		cert.CertificateChain, err = acmeutils.LoadCertificates(b)
+		cert.AlternateURLs = linksByRel(res.Header, "alternate", url)
 		isCertificate = true
 		return
 	}
@@ -430,7 +654,8 @@ type revokeReq struct {
 
 // Requests revocation of a certificate. The certificate must be provided in
 // DER form. If revocationKey is non-nil, the revocation request is signed with
-// the given key; otherwise, the request is signed with the account key.
+// the given key, which may be any crypto.Signer; otherwise, the request is
+// signed with the account key.
 //
 // In general, you should expect to be able to revoke any certificate if a
 // request to do so is signed using that certificate's key. You should also
@@ -456,7 +681,14 @@ func (c *RealmClient) Revoke(ctx context.Context, acct *Account, certificateDER
 		Reason:      reason,
 	}
 
-	res, err := c.doReq(ctx, "POST", di.RevokeCert, nil, revocationKey, req, nil)
+	// A request signed with the certificate key embeds the public key rather
+	// than referencing an account.
+	signingAcct := acct
+	if revocationKey != nil {
+		signingAcct = &noAccountNeeded
+	}
+
+	res, err := c.doReq(ctx, "POST", di.RevokeCert, signingAcct, revocationKey, req, nil)
 	if err != nil {
 		return err
 	}
@@ -472,20 +704,201 @@ func (ord *Order) validate() error {
 // Submit a challenge response. Only the challenge URL is required to be set in
 // the Challenge object. The account need only have the URL set.
 func (c *RealmClient) RespondToChallenge(ctx context.Context, acct *Account, ch *Challenge, response json.RawMessage) error {
-	_, err := c.doReq(ctx, "POST", ch.URL, acct, nil, &response, ch)
+	res, err := c.doReq(ctx, "POST", ch.URL, acct, nil, &response, ch)
+	if err != nil {
+		return err
+	}
+
+	c.cfg.RateLimiter.noteChallenge(ch)
+	ch.retryAt = retryAtDefault(res.Header, defaultPollTime)
+	return nil
+}
+
+// Load or reload a challenge. Only the challenge URL is required to be set.
+func (c *RealmClient) LoadChallenge(ctx context.Context, acct *Account, ch *Challenge) error {
+	// POST-as-GET.
+	res, err := c.doReq(ctx, "POST", ch.URL, acct, nil, "", ch)
 	if err != nil {
 		return err
 	}
 
+	c.cfg.RateLimiter.noteChallenge(ch)
+	ch.retryAt = retryAtDefault(res.Header, defaultPollTime)
 	return nil
 }
 
+// Like LoadChallenge, but waits the retry time if this is not the first
+// attempt to load this challenge. To be used when polling.
+//
+// The retry delay will not work if you recreate the object; use the same
+// Challenge struct between calls.
+func (c *RealmClient) WaitLoadChallenge(ctx context.Context, acct *Account, ch *Challenge) error {
+	err := waitUntil(ctx, ch.retryAt)
+	if err != nil {
+		return err
+	}
+
+	return c.LoadChallenge(ctx, acct, ch)
+}
+
+// Wait for a challenge to reach a final state, typically after calling
+// RespondToChallenge. Only the URL is required to be set. Returns nil if the
+// challenge becomes valid; otherwise, an error of type *ValidationError is
+// returned.
+func (c *RealmClient) WaitForChallenge(ctx context.Context, acct *Account, ch *Challenge) error {
+	for ch.Status == "" || !ch.Status.IsFinal() {
+		err := c.WaitLoadChallenge(ctx, acct, ch)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ch.Status == ChallengeValid {
+		return nil
+	}
+
+	return &ValidationError{
+		Challenge: ch,
+		Problem:   ch.Error,
+	}
+}
+
+// Error returned by WaitForAuthorization and WaitForChallenge when an
+// authorization or challenge reaches a final state other than valid.
+type ValidationError struct {
+	// The authorization which failed. nil if the error was returned by
+	// WaitForChallenge.
+	Authorization *Authorization
+
+	// The challenge which failed. May be nil if the authorization failed but
+	// none of its challenges is marked invalid, e.g. because the authorization
+	// was deactivated.
+	Challenge *Challenge
+
+	// The error reported by the server for the failed challenge, if any.
+	Problem *Problem
+}
+
+func (e *ValidationError) Error() string {
+	var s string
+	switch {
+	case e.Authorization != nil:
+		s = fmt.Sprintf("authorization for %v has status %q", &e.Authorization.Identifier, e.Authorization.Status)
+	case e.Challenge != nil:
+		s = fmt.Sprintf("challenge %q has status %q", e.Challenge.URL, e.Challenge.Status)
+	default:
+		s = "validation failed"
+	}
+
+	if e.Problem != nil {
+		s += ": " + e.Problem.Error()
+	}
+
+	return s
+}
+
+// Returns the problem reported by the server, if any.
+func (e *ValidationError) Unwrap() error {
+	if e.Problem == nil {
+		return nil
+	}
+
+	return e.Problem
+}
+
+type keyChangeReq struct {
+	Account string           `json:"account"`
+	OldKey  *jose.JSONWebKey `json:"oldKey"`
+}
+
+// Error returned by ChangeKey when the server reports that the new key is
+// already in use by another account.
+type KeyConflictError struct {
+	// The URL of the account which is already using the new key.
+	AccountURL string
+
+	// The underlying error returned by the server.
+	HTTPError *HTTPError
+}
+
+func (e *KeyConflictError) Error() string {
+	return fmt.Sprintf("key is already in use by account %q", e.AccountURL)
+}
+
+// Returns the underlying HTTPError, if any.
+func (e *KeyConflictError) Unwrap() error {
+	if e.HTTPError == nil {
+		return nil
+	}
+
+	return e.HTTPError
+}
+
 // Submit a key change request. The acct specified is used to authorize the
 // change; the key for the account identified by acct.URL is changed from
 // acct.PrivateKey/acct.Key to the key specified by newKey.
 //
 // When this method returns nil error, the key has been successfully changed.
 // The acct object's Key and PrivateKey fields will also be changed to newKey.
+//
+// If the server reports that newKey is already in use by another account, an
+// error of type *KeyConflictError is returned.
 func (c *RealmClient) ChangeKey(ctx context.Context, acct *Account, newKey crypto.PrivateKey) error {
-	panic("not yet implemented")
+	if !ValidURL(acct.URL) {
+		return fmt.Errorf("cannot change key of account for which URL is unknown")
+	}
+
+	di, err := c.getDirectory(ctx)
+	if err != nil {
+		return err
+	}
+
+	if di.KeyChange == "" {
+		return fmt.Errorf("endpoint does not support key change")
+	}
+
+	oldPub, err := publicKeyFromKey(acct.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	newPub, err := publicKeyFromKey(newKey)
+	if err != nil {
+		return err
+	}
+
+	// The inner JWS is signed by the new key, embeds the new key as a JWK and
+	// has no nonce.
+	inner, err := signJWS(newKey, c.signatureAlgorithm(nil, newKey), &keyChangeReq{
+		Account: acct.URL,
+		OldKey:  &jose.JSONWebKey{Key: oldPub},
+	}, &jose.SignerOptions{
+		EmbedJWK: true,
+		ExtraHeaders: map[jose.HeaderKey]interface{}{
+			"url": di.KeyChange,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// The outer JWS is signed by the old key in the usual way.
+	res, err := c.doReq(ctx, "POST", di.KeyChange, acct, nil, json.RawMessage(inner), nil)
+	if err != nil {
+		if he, ok := err.(*HTTPError); ok && he.Res.StatusCode == 409 {
+			if loc := he.Res.Header.Get("Location"); loc != "" {
+				return &KeyConflictError{
+					AccountURL: loc,
+					HTTPError:  he,
+				}
+			}
+		}
+
+		return err
+	}
+	defer res.Body.Close()
+
+	acct.PrivateKey = newKey
+	acct.Key = &jose.JSONWebKey{Key: newPub}
+	return nil
 }
@@ -0,0 +1,554 @@
+package acmeapi
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"gopkg.in/square/go-jose.v2"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	return pk
+}
+
+func TestChangeKey(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+	acct := &Account{
+		URL:        ts.URL + "/acct/1",
+		PrivateKey: oldKey,
+	}
+
+	ts.Handle("/key-change", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		if jws.Signatures[0].Protected.KeyID != acct.URL {
+			t.Errorf("outer JWS has wrong kid: %q", jws.Signatures[0].Protected.KeyID)
+		}
+		if _, err := jws.Verify(&oldKey.PublicKey); err != nil {
+			t.Errorf("outer JWS not signed by old key: %v", err)
+		}
+
+		inner, err := jose.ParseSigned(string(payload))
+		if err != nil {
+			t.Errorf("cannot parse inner JWS: %v", err)
+			return
+		}
+
+		h := inner.Signatures[0].Protected
+		if h.JSONWebKey == nil || h.Nonce != "" || h.ExtraHeaders["url"] != ts.Directory["keyChange"] {
+			t.Errorf("inner JWS has unexpected header: %#v", h)
+		}
+
+		innerPayload, err := inner.Verify(&newKey.PublicKey)
+		if err != nil {
+			t.Errorf("inner JWS not signed by new key: %v", err)
+			return
+		}
+
+		var kc struct {
+			Account string          `json:"account"`
+			OldKey  jose.JSONWebKey `json:"oldKey"`
+		}
+		err = json.Unmarshal(innerPayload, &kc)
+		if err != nil {
+			t.Errorf("cannot unmarshal key change request: %v", err)
+			return
+		}
+		if kc.Account != acct.URL {
+			t.Errorf("wrong account URL: %q", kc.Account)
+		}
+		if pub, ok := kc.OldKey.Key.(*ecdsa.PublicKey); !ok || pub.X.Cmp(oldKey.X) != 0 {
+			t.Errorf("wrong old key: %#v", kc.OldKey.Key)
+		}
+
+		if req.URL.Query().Get("conflict") != "" {
+			rw.Header().Set("Location", ts.URL+"/acct/2")
+			ts.writeProblem(rw, 409, &Problem{Type: "urn:ietf:params:acme:error:malformed"})
+			return
+		}
+
+		ts.writeJSON(rw, 200, map[string]interface{}{"status": "valid"})
+	})
+
+	rc := ts.Client()
+	err := rc.ChangeKey(context.TODO(), acct, newKey)
+	if err != nil {
+		t.Fatalf("key change failed: %v", err)
+	}
+
+	if acct.PrivateKey != newKey {
+		t.Fatalf("account private key not updated")
+	}
+	if pub, ok := acct.Key.Key.(*ecdsa.PublicKey); !ok || pub.X.Cmp(newKey.X) != 0 {
+		t.Fatalf("account public key not updated")
+	}
+
+	ts.Directory["keyChange"] = ts.URL + "/key-change?conflict=1"
+	rc = ts.Client()
+	acct.PrivateKey = oldKey
+	err = rc.ChangeKey(context.TODO(), acct, newKey)
+	kce, ok := err.(*KeyConflictError)
+	if !ok {
+		t.Fatalf("expected key conflict error, got %v", err)
+	}
+	if kce.AccountURL != ts.URL+"/acct/2" {
+		t.Fatalf("wrong conflicting account URL: %q", kce.AccountURL)
+	}
+	if acct.PrivateKey != oldKey {
+		t.Fatalf("account key changed despite conflict")
+	}
+}
+
+func TestRegisterAccountEAB(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	ts.Directory["meta"] = map[string]interface{}{
+		"externalAccountRequired": true,
+	}
+
+	hmacKey := []byte("0123456789abcdef0123456789abcdef")
+	key := newTestKey(t)
+
+	ts.Handle("/new-account", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		var pa struct {
+			ExternalAccountBinding json.RawMessage `json:"externalAccountBinding"`
+		}
+		err := json.Unmarshal(payload, &pa)
+		if err != nil {
+			t.Errorf("cannot unmarshal account: %v", err)
+			return
+		}
+
+		eab, err := jose.ParseSigned(string(pa.ExternalAccountBinding))
+		if err != nil {
+			t.Errorf("cannot parse EAB JWS: %v", err)
+			return
+		}
+
+		h := eab.Signatures[0].Protected
+		if h.Algorithm != "HS384" || h.KeyID != "kid-1" || h.ExtraHeaders["url"] != ts.URL+"/new-account" || h.Nonce != "" {
+			t.Errorf("unexpected EAB header: %#v", h)
+		}
+
+		eabPayload, err := eab.Verify(hmacKey)
+		if err != nil {
+			t.Errorf("EAB MAC verification failed: %v", err)
+			return
+		}
+
+		var jwk jose.JSONWebKey
+		err = json.Unmarshal(eabPayload, &jwk)
+		if err != nil {
+			t.Errorf("EAB payload is not a JWK: %v", err)
+			return
+		}
+		if pub, ok := jwk.Key.(*ecdsa.PublicKey); !ok || pub.X.Cmp(key.X) != 0 {
+			t.Errorf("EAB payload is not the account key")
+		}
+
+		rw.Header().Set("Location", ts.URL+"/acct/1")
+		ts.writeJSON(rw, 201, map[string]interface{}{"status": "valid"})
+	})
+
+	rc := ts.Client()
+	acct := &Account{
+		PrivateKey:           key,
+		TermsOfServiceAgreed: true,
+	}
+	err := rc.RegisterAccount(context.TODO(), acct)
+	if err != ErrExternalAccountRequired {
+		t.Fatalf("expected ErrExternalAccountRequired, got %v", err)
+	}
+
+	acct.ExternalAccountBinding = &ExternalAccountBinding{
+		KeyID:     "kid-1",
+		HMACKey:   hmacKey,
+		Algorithm: jose.HS384,
+	}
+	err = rc.RegisterAccount(context.TODO(), acct)
+	if err != nil {
+		t.Fatalf("registration failed: %v", err)
+	}
+	if acct.URL != ts.URL+"/acct/1" {
+		t.Fatalf("unexpected account URL: %q", acct.URL)
+	}
+}
+
+func TestNewOrder(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	ts.Handle("/new-order", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		var po map[string]interface{}
+		err := json.Unmarshal(payload, &po)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if po["replaces"] != "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE" {
+			t.Errorf("unexpected replaces field: %v", po["replaces"])
+		}
+		if po["profile"] != "shortlived" {
+			t.Errorf("unexpected profile field: %v", po["profile"])
+		}
+
+		rw.Header().Set("Location", ts.URL+"/order/1")
+		ts.writeJSON(rw, 201, po)
+	})
+
+	ts.Directory["meta"] = map[string]interface{}{
+		"profiles": map[string]string{
+			"classic":    "https://example.com/docs/classic",
+			"shortlived": "https://example.com/docs/shortlived",
+		},
+	}
+
+	rc := ts.Client()
+	acct := &Account{URL: ts.URL + "/acct/1", PrivateKey: newTestKey(t)}
+
+	meta, err := rc.GetMeta(context.TODO())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !meta.HasProfile("classic") || meta.HasProfile("tlsserver") {
+		t.Fatalf("unexpected profiles: %#v", meta.Profiles)
+	}
+
+	order := &Order{
+		Identifiers: []Identifier{{Type: IdentifierTypeDNS, Value: "example.com"}},
+		Replaces:    "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE",
+		Profile:     "tlsserver",
+	}
+	err = rc.NewOrder(context.TODO(), acct, order)
+	if err == nil {
+		t.Fatalf("order with unknown profile did not fail")
+	}
+
+	order.Profile = "shortlived"
+	err = rc.NewOrder(context.TODO(), acct, order)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if order.URL != ts.URL+"/order/1" {
+		t.Fatalf("unexpected order URL: %q", order.URL)
+	}
+}
+
+func TestListOrders(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	ts.Handle("/orders/", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		if jws == nil || len(payload) != 0 {
+			t.Errorf("expected POST-as-GET request")
+		}
+
+		switch req.URL.Query().Get("cursor") {
+		case "":
+			rw.Header().Add("Link", `</orders/1?cursor=2>;rel="next"`)
+			ts.writeJSON(rw, 200, map[string]interface{}{"orders": []string{ts.URL + "/order/1", ts.URL + "/order/2"}})
+		case "2":
+			ts.writeJSON(rw, 200, map[string]interface{}{"orders": []string{ts.URL + "/order/3"}})
+		default:
+			t.Errorf("unexpected request: %v", req.URL)
+		}
+	})
+
+	rc := ts.Client()
+	acct := &Account{URL: ts.URL + "/acct/1", PrivateKey: newTestKey(t)}
+	_, err := rc.ListOrders(context.TODO(), acct)
+	if err == nil {
+		t.Fatal()
+	}
+
+	acct.OrdersURL = ts.URL + "/orders/1"
+	orderURLs, err := rc.ListOrders(context.TODO(), acct)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if len(orderURLs) != 3 || orderURLs[2] != ts.URL+"/order/3" {
+		t.Fatalf("unexpected orders: %#v", orderURLs)
+	}
+}
+
+func TestDeactivateAuthorization(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	statuses := map[string]string{
+		"/authz/1": "pending",
+		"/authz/2": "invalid",
+		"/authz/3": "valid",
+		"/authz/4": "valid",
+	}
+
+	ts.Handle("/authz/", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		if len(payload) != 0 {
+			var r map[string]interface{}
+			err := json.Unmarshal(payload, &r)
+			if err != nil || r["status"] != "deactivated" || len(r) != 1 {
+				t.Errorf("unexpected deactivation request: %s", payload)
+			}
+
+			if req.URL.Path != "/authz/4" {
+				statuses[req.URL.Path] = "deactivated"
+			}
+			rw.Header().Set("Retry-After", "30")
+		}
+
+		ts.writeJSON(rw, 200, map[string]interface{}{
+			"identifier": map[string]interface{}{"type": "dns", "value": "example.com"},
+			"status":     statuses[req.URL.Path],
+			"challenges": []interface{}{map[string]interface{}{"type": "http-01", "url": ts.URL + "/chall/1", "status": "pending"}},
+		})
+	})
+
+	rc := ts.Client()
+	acct := &Account{URL: ts.URL + "/acct/1", PrivateKey: newTestKey(t)}
+	order := &Order{
+		AuthorizationURLs: []string{ts.URL + "/authz/1", ts.URL + "/authz/2", ts.URL + "/authz/3"},
+	}
+
+	azs, err := rc.DeactivateOrderAuthorizations(context.TODO(), acct, order)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if len(azs) != 2 || azs[0].URL != ts.URL+"/authz/1" || azs[1].URL != ts.URL+"/authz/3" {
+		t.Fatalf("unexpected deactivated authorizations: %#v", azs)
+	}
+
+	for _, az := range azs {
+		if az.Status != AuthorizationDeactivated {
+			t.Fatalf("authorization not deactivated: %v", az.Status)
+		}
+		if d := az.retryAt.Sub(time.Now()); d < 25*time.Second || d > 30*time.Second {
+			t.Fatalf("Retry-After not honoured: %v", d)
+		}
+	}
+
+	if statuses["/authz/2"] != "invalid" {
+		t.Fatalf("invalid authorization was deactivated")
+	}
+
+	// A server which does not deactivate the authorization is reported.
+	err = rc.DeactivateAuthorization(context.TODO(), acct, &Authorization{URL: ts.URL + "/authz/4"})
+	if err == nil {
+		t.Fatalf("expected error for authorization which was not deactivated")
+	}
+}
+
+func TestWaitForChallenge(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	polls := map[string]int{}
+	ts.Handle("/chall/", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		polls[req.URL.Path]++
+		ch := map[string]interface{}{"type": "http-01", "url": ts.URL + req.URL.Path, "status": "processing", "token": "x"}
+		if polls[req.URL.Path] == 3 {
+			if req.URL.Path == "/chall/1" {
+				ch["status"] = "valid"
+			} else {
+				ch["status"] = "invalid"
+				ch["error"] = map[string]interface{}{"type": "urn:ietf:params:acme:error:connection", "detail": "timeout"}
+			}
+		}
+
+		rw.Header().Set("Retry-After", "0")
+		ts.writeJSON(rw, 200, ch)
+	})
+
+	rc := ts.Client()
+	acct := &Account{URL: ts.URL + "/acct/1", PrivateKey: newTestKey(t)}
+
+	ch := &Challenge{URL: ts.URL + "/chall/1"}
+	err := rc.WaitForChallenge(context.TODO(), acct, ch)
+	if err != nil || ch.Status != ChallengeValid || polls["/chall/1"] != 3 {
+		t.Fatalf("unexpected result: %v %v %d", err, ch.Status, polls["/chall/1"])
+	}
+
+	ch = &Challenge{URL: ts.URL + "/chall/2"}
+	err = rc.WaitForChallenge(context.TODO(), acct, ch)
+	ve, ok := err.(*ValidationError)
+	if !ok || ve.Challenge != ch || ve.Problem == nil || ve.Problem.Detail != "timeout" {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	if _, ok := ve.Unwrap().(*Problem); !ok {
+		t.Fatal()
+	}
+}
+
+func TestWaitForAuthorization(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	polls := 0
+	ts.Handle("/authz/1", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		polls++
+		az := map[string]interface{}{
+			"identifier": map[string]interface{}{"type": "dns", "value": "example.com"},
+			"status":     "pending",
+			"challenges": []interface{}{
+				map[string]interface{}{"type": "http-01", "url": ts.URL + "/chall/1", "status": "processing"},
+			},
+		}
+		if polls == 2 {
+			az["status"] = "invalid"
+			az["challenges"] = []interface{}{
+				map[string]interface{}{"type": "http-01", "url": ts.URL + "/chall/1", "status": "invalid",
+					"error": map[string]interface{}{"type": "urn:ietf:params:acme:error:unauthorized", "detail": "wrong content"}},
+			}
+		}
+
+		rw.Header().Set("Retry-After", "0")
+		ts.writeJSON(rw, 200, az)
+	})
+
+	rc := ts.Client()
+	acct := &Account{URL: ts.URL + "/acct/1", PrivateKey: newTestKey(t)}
+
+	az := &Authorization{URL: ts.URL + "/authz/1"}
+	err := rc.WaitForAuthorization(context.TODO(), acct, az)
+	ve, ok := err.(*ValidationError)
+	if !ok || ve.Authorization != az || ve.Challenge == nil || ve.Problem == nil || ve.Problem.Detail != "wrong content" {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	if polls != 2 {
+		t.Fatalf("unexpected number of polls: %d", polls)
+	}
+}
+
+func TestRefreshDirectory(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	ts.Handle("/new-order", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		ts.writeProblem(rw, 404, &Problem{Type: string(ProblemMalformed)})
+	})
+	ts.Handle("/new-order-2", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		rw.Header().Set("Location", ts.URL+"/order/1")
+		ts.writeJSON(rw, 201, map[string]interface{}{"status": "pending"})
+	})
+	tosLink := "https://example.com/tos-2"
+	ts.Handle("/acct/1", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		rw.Header().Add("Link", "<"+tosLink+`>;rel="terms-of-service"`)
+		ts.writeProblem(rw, 403, &Problem{Type: string(ProblemUserActionRequired)})
+	})
+
+	ts.Directory["meta"] = map[string]interface{}{"termsOfService": "https://example.com/tos-1"}
+	rc := ts.Client()
+	acct := &Account{URL: ts.URL + "/acct/1", PrivateKey: newTestKey(t)}
+	getTOS := func() string {
+		meta, err := rc.GetMeta(context.TODO())
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return meta.TermsOfServiceURL
+	}
+
+	if getTOS() != "https://example.com/tos-1" {
+		t.Fatal()
+	}
+
+	// Changes are not seen until the directory is refreshed.
+	ts.Directory["meta"] = map[string]interface{}{"termsOfService": "https://example.com/tos-2"}
+	if getTOS() != "https://example.com/tos-1" {
+		t.Fatal()
+	}
+
+	err := rc.RefreshDirectory(context.TODO())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if getTOS() != "https://example.com/tos-2" {
+		t.Fatal()
+	}
+
+	// A userActionRequired problem refreshes the directory if it refers to
+	// new terms of service.
+	ts.Directory["meta"] = map[string]interface{}{"termsOfService": "https://example.com/tos-3"}
+	err = rc.UpdateAccount(context.TODO(), acct)
+	if !errors.Is(err, ProblemUserActionRequired) || getTOS() != "https://example.com/tos-2" {
+		t.Fatalf("unexpected result: %v %v", err, getTOS())
+	}
+
+	tosLink = "https://example.com/tos-3"
+	err = rc.UpdateAccount(context.TODO(), acct)
+	if !errors.Is(err, ProblemUserActionRequired) || getTOS() != "https://example.com/tos-3" {
+		t.Fatalf("unexpected result: %v %v", err, getTOS())
+	}
+
+	// A 404 from an endpoint listed in the directory refreshes the directory.
+	// If the endpoint has moved, the request is retried at the new URL.
+	order := &Order{Identifiers: []Identifier{{Type: IdentifierTypeDNS, Value: "example.com"}}}
+	err = rc.NewOrder(context.TODO(), acct, order)
+	if err == nil {
+		t.Fatal()
+	}
+
+	ts.Directory["newOrder"] = ts.URL + "/new-order-2"
+	err = rc.NewOrder(context.TODO(), acct, order)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if order.URL != ts.URL+"/order/1" {
+		t.Fatalf("unexpected order URL: %q", order.URL)
+	}
+}
+
+func TestDirectoryTTL(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	requests := 0
+	ts.Handle("/dir2", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		requests++
+		if requests == 3 {
+			ts.writeProblem(rw, 500, &Problem{Type: string(ProblemServerInternal)})
+			return
+		}
+
+		ts.writeJSON(rw, 200, ts.Directory)
+	})
+
+	rc, err := NewRealmClient(RealmClientConfig{
+		DirectoryURL: ts.URL + "/dir2",
+		DirectoryTTL: time.Hour,
+		RetryPolicy:  RetryPolicy{MaxTries: 1},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	withClock(slowClk, func() {
+		for i, expected := range []int{1, 1, 2, 3, 3, 4} {
+			_, err := rc.GetMeta(context.TODO())
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if requests != expected {
+				t.Fatalf("%d: unexpected number of requests: %d", i, requests)
+			}
+
+			// The directory is refreshed once the TTL expires. If the refresh
+			// fails, the cached directory is used and the refresh is retried
+			// later.
+			slowClk.Advance([]time.Duration{30 * time.Minute, 31 * time.Minute, 61 * time.Minute, 30 * time.Second, 31 * time.Second, 0}[i])
+		}
+	})
+}
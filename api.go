@@ -7,11 +7,11 @@ import (
 	"context"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"encoding/json"
 	"errors"
 	"fmt"
-	gnet "github.com/hlandau/goutils/net"
 	"github.com/hlandau/xlog"
 	"github.com/peterhellberg/link"
 	"golang.org/x/net/context/ctxhttp"
@@ -72,6 +72,22 @@ type RealmClientConfig struct {
 	// Optional. Custom User-Agent string. If not specified, uses the global
 	// User-Agent string configured at acmeapi package level (UserAgent var).
 	UserAgent string
+
+	// Optional. Controls how requests which fail transiently are retried. See
+	// RetryPolicy for the defaults.
+	RetryPolicy RetryPolicy
+
+	// Optional. If set, used to avoid making requests which would exceed the
+	// rate limits of the realm. See RateLimiter.
+	RateLimiter *RateLimiter
+
+	// Optional. Controls the pool of nonces kept by the client. See
+	// NoncePoolConfig for the defaults.
+	NoncePool NoncePoolConfig
+
+	// Optional. How long the directory is cached before it is retrieved again.
+	// Defaults to 24 hours. See also RefreshDirectory.
+	DirectoryTTL time.Duration
 }
 
 // Client used to access and mutate resources provided by an ACME server.
@@ -163,17 +179,86 @@ type RealmClient struct {
 
 	dir      atomic.Value // *directoryInfo
 	dirMutex sync.Mutex   // Ensures single flight for directory requests.
+
+	algMutex     sync.Mutex
+	acceptedAlgs []jose.SignatureAlgorithm // Set from "badSignatureAlgorithm" problems.
 }
 
 // Directory resource structure.
 type directoryInfo struct {
-	NewNonce   string    `json:"newNonce"`
-	NewAccount string    `json:"newAccount"`
-	NewOrder   string    `json:"newOrder"`
-	NewAuthz   string    `json:"newAuthz"`
-	RevokeCert string    `json:"revokeCert"`
-	KeyChange  string    `json:"keyChange"`
-	Meta       RealmMeta `json:"meta"`
+	NewNonce    string    `json:"newNonce"`
+	NewAccount  string    `json:"newAccount"`
+	NewOrder    string    `json:"newOrder"`
+	NewAuthz    string    `json:"newAuthz"`
+	RevokeCert  string    `json:"revokeCert"`
+	KeyChange   string    `json:"keyChange"`
+	RenewalInfo string    `json:"renewalInfo"`
+	Meta        RealmMeta `json:"meta"`
+
+	expires time.Time // Time after which the directory should be refreshed.
+}
+
+// Returns the URL given by this directory for the endpoint which has the URL
+// u in the directory old, or "" if u is not an endpoint in old or the
+// endpoint is not present in this directory.
+func (di *directoryInfo) translateEndpoint(old *directoryInfo, u string) string {
+	if u == "" {
+		return ""
+	}
+
+	switch u {
+	case old.NewNonce:
+		return di.NewNonce
+	case old.NewAccount:
+		return di.NewAccount
+	case old.NewOrder:
+		return di.NewOrder
+	case old.NewAuthz:
+		return di.NewAuthz
+	case old.RevokeCert:
+		return di.RevokeCert
+	case old.KeyChange:
+		return di.KeyChange
+	}
+
+	if certID, ok := old.renewalInfoCertID(u); ok && di.RenewalInfo != "" {
+		return di.renewalInfoURL(certID)
+	}
+
+	return ""
+}
+
+// Returns the URL of the renewal information for the certificate with the
+// given ARI certificate identifier. The renewalInfo URL in the directory may
+// or may not have a trailing slash.
+func (di *directoryInfo) renewalInfoURL(certID string) string {
+	return strings.TrimSuffix(di.RenewalInfo, "/") + "/" + certID
+}
+
+// If u is a renewal information URL under the renewalInfo endpoint of the
+// directory, returns the certificate identifier and true.
+func (di *directoryInfo) renewalInfoCertID(u string) (string, bool) {
+	if di.RenewalInfo == "" {
+		return "", false
+	}
+
+	certID := strings.TrimPrefix(u, strings.TrimSuffix(di.RenewalInfo, "/")+"/")
+	if certID == u || certID == "" {
+		return "", false
+	}
+
+	return certID, true
+}
+
+// Returns true iff the URL is one of the endpoints listed in the directory.
+func (di *directoryInfo) hasEndpoint(u string) bool {
+	switch u {
+	case di.NewNonce, di.NewAccount, di.NewOrder, di.NewAuthz, di.RevokeCert, di.KeyChange:
+		return u != ""
+	default:
+		_, ok := di.renewalInfoCertID(u)
+		return ok
+	}
 }
 
 // Metadata for a realm, retrieved from the directory resource.
@@ -189,8 +274,21 @@ type RealmMeta struct {
 	// referring to itself for the purposes of CAA record validation.
 	CAAIdentities []string `json:"caaIdentities,omitempty"`
 
-	// (Sent by server; optional.) As per specification.
+	// (Sent by server; optional.) If true, the CA requires new accounts to be
+	// bound to an external account; see Account.ExternalAccountBinding.
 	ExternalAccountRequired bool `json:"externalAccountRequired,omitempty"`
+
+	// (Sent by server; optional.) The certificate profiles offered by the CA,
+	// mapping profile names to human-readable descriptions (typically URLs of
+	// documents describing the profiles). A profile may be requested by name
+	// when creating an order; see Order.Profile.
+	Profiles map[string]string `json:"profiles,omitempty"`
+}
+
+// Returns true iff the realm offers a certificate profile with the given name.
+func (m *RealmMeta) HasProfile(name string) bool {
+	_, ok := m.Profiles[name]
+	return ok
 }
 
 // Instantiates a new RealmClient.
@@ -204,6 +302,7 @@ func NewRealmClient(cfg RealmClientConfig) (*RealmClient, error) {
 	}
 
 	rc.nonceSource.GetNonceFunc = rc.obtainNewNonce
+	rc.nonceSource.Config = rc.cfg.NoncePool
 
 	return rc, nil
 }
@@ -217,35 +316,124 @@ func (c *RealmClient) getDirectoryURL() string {
 
 // Directory Retrieval
 
+const defaultDirectoryTTL = 24 * time.Hour
+
+// If retrieving the directory to refresh an expired cached copy fails, the
+// cached copy continues to be used for this long before trying again.
+const directoryRefreshRetryTime = 1 * time.Minute
+
 // Returns the directory information for the realm accessed by the RealmClient.
 //
 // This may return instantly (if the directory information has already been
 // retrieved and cached), or may cause a request to be made to retrieve and
-// cache the information, hence the context argument.
+// cache the information, hence the context argument. Cached directory
+// information is retrieved again once it is older than the configured
+// DirectoryTTL; if this fails, the cached information continues to be used.
 //
 // Multiple concurrent calls to getDirectory with no directory information
 // cached result only in a single request being made; all of the callers to
 // getDirectory wait for the single request.
 func (c *RealmClient) getDirectory(ctx context.Context) (*directoryInfo, error) {
 	dir := c.getDirp()
-	if dir != nil {
+	if dir != nil && defaultClock.Now().Before(dir.expires) {
 		return dir, nil
 	}
 
 	c.dirMutex.Lock()
 	defer c.dirMutex.Unlock()
 
-	if dir := c.getDirp(); dir != nil {
+	dir = c.getDirp()
+	if dir != nil && defaultClock.Now().Before(dir.expires) {
+		return dir, nil
+	}
+
+	newDir, err := c.getDirectoryActual(ctx)
+	if err != nil {
+		if dir == nil {
+			return nil, err
+		}
+
+		log.Debugf("failed to refresh directory, continuing to use cached directory: %v", err)
+		staleDir := *dir
+		staleDir.expires = defaultClock.Now().Add(directoryRefreshRetryTime)
+		c.setDirp(&staleDir)
 		return dir, nil
 	}
 
+	c.setDirp(newDir)
+	return newDir, nil
+}
+
+// Retrieves the directory for the realm, replacing any cached directory
+// information. This can be used to ensure that changes to the directory, such
+// as new endpoints, new terms of service or changed metadata, are seen
+// immediately rather than once the cached directory expires.
+//
+// The directory is also refreshed automatically if an endpoint listed in it
+// responds with 404, or if the server reports that agreement to new terms of
+// service is required. In the former case, if the refreshed directory gives a
+// different URL for the endpoint, the failed request is retried once against
+// the new URL; otherwise the request which triggered the refresh still fails.
+func (c *RealmClient) RefreshDirectory(ctx context.Context) error {
+	c.dirMutex.Lock()
+	defer c.dirMutex.Unlock()
+
 	dir, err := c.getDirectoryActual(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	c.setDirp(dir)
-	return dir, nil
+	return nil
+}
+
+// Refreshes the cached directory if err, returned by a request to the given
+// URL, suggests that it is out of date. If u was a directory endpoint which
+// returned 404 and the refreshed directory gives a different URL for that
+// endpoint, returns the new URL; otherwise returns "".
+func (c *RealmClient) refreshDirectoryIfStale(ctx context.Context, u string, err error) string {
+	var he *HTTPError
+	if !errors.As(err, &he) {
+		return ""
+	}
+
+	// Errors retrieving the directory itself never trigger a refresh, as the
+	// directory mutex is held while it is retrieved.
+	dir := c.getDirp()
+	if dir == nil || u == c.getDirectoryURL() {
+		return ""
+	}
+
+	stale := he.Res.StatusCode == 404 && dir.hasEndpoint(u)
+	if errors.Is(he, ProblemUserActionRequired) {
+		for _, tosURL := range linksByRel(he.Res.Header, "terms-of-service", u) {
+			if tosURL != dir.Meta.TermsOfServiceURL {
+				stale = true
+			}
+		}
+	}
+
+	if !stale {
+		return ""
+	}
+
+	log.Debugf("refreshing directory after error: %v", err)
+	err = c.RefreshDirectory(ctx)
+	if err != nil {
+		log.Debugf("failed to refresh directory: %v", err)
+		return ""
+	}
+
+	if he.Res.StatusCode != 404 {
+		return ""
+	}
+
+	newURL := c.getDirp().translateEndpoint(dir, u)
+	if newURL == u {
+		return ""
+	}
+
+	return newURL
 }
 
 func (c *RealmClient) getDirp() *directoryInfo {
@@ -280,6 +468,12 @@ func (c *RealmClient) getDirectoryActual(ctx context.Context) (*directoryInfo, e
 		return nil, ErrMissingEndpoints
 	}
 
+	ttl := c.cfg.DirectoryTTL
+	if ttl == 0 {
+		ttl = defaultDirectoryTTL
+	}
+
+	dir.expires = defaultClock.Now().Add(ttl)
 	return dir, nil
 }
 
@@ -296,6 +490,11 @@ func (c *RealmClient) GetMeta(ctx context.Context) (RealmMeta, error) {
 	return di.Meta, nil
 }
 
+// Returns counters describing the use of the client's nonce pool.
+func (c *RealmClient) NonceStats() NonceStats {
+	return c.nonceSource.Stats()
+}
+
 // This method is configured as the GetNewNonce function for the nonceSource
 // which constitutes part of the RealmClient. It is called if the nonceSource's
 // cache of nonces is empty, meaning that an HTTP request must be made to
@@ -342,35 +541,73 @@ func (c *RealmClient) doReq(ctx context.Context, method, url string, acct *Accou
 }
 
 func (c *RealmClient) doReqAccept(ctx context.Context, method, url, accepts string, acct *Account, key crypto.PrivateKey, requestData, responseData interface{}) (*http.Response, error) {
-	backoff := gnet.Backoff{
-		MaxTries:           20,
-		InitialDelay:       100 * time.Millisecond,
-		MaxDelay:           1 * time.Second,
-		MaxDelayAfterTries: 4,
-		Jitter:             0.10,
+	res, err := c.doReqRetry(ctx, method, url, accepts, acct, key, requestData, responseData)
+	if err != nil {
+		// If the refreshed directory gives a different URL for the endpoint,
+		// the request failed only because the directory was out of date, so
+		// retry it once against the new URL.
+		if newURL := c.refreshDirectoryIfStale(ctx, url, err); newURL != "" {
+			log.Debugf("retrying request to %q at %q after directory refresh", url, newURL)
+			return c.doReqRetry(ctx, method, newURL, accepts, acct, key, requestData, responseData)
+		}
 	}
 
-	for {
-		res, err := c.doReqOneTry(ctx, method, url, accepts, acct, key, requestData, responseData)
+	return res, err
+}
+
+func (c *RealmClient) doReqRetry(ctx context.Context, method, url, accepts string, acct *Account, key crypto.PrivateKey, requestData, responseData interface{}) (*http.Response, error) {
+	rp := c.cfg.RetryPolicy.withDefaults()
+
+	// Requests which do not change server state can safely be retried after
+	// failures which leave it unclear whether the request was processed.
+	s, isString := requestData.(string)
+	idempotent := method == "GET" || method == "HEAD" || (isString && s == "")
+
+	for tries := 1; ; tries++ {
+		alg := c.signatureAlgorithm(acct, key)
+		res, err := c.doReqOneTry(ctx, method, url, accepts, acct, key, alg, requestData, responseData)
 		if err == nil {
 			return res, nil
 		}
 
-		// If the error is specifically a "bad nonce" error, we are supposed to
-		// retry.
-		if he, ok := err.(*HTTPError); ok && he.Problem != nil && he.Problem.Type == "urn:ietf:params:acme:error:badNonce" {
-			if backoff.Sleep() {
-				log.Debugf("retrying after bad nonce: %v\n", he)
-				continue
+		if tries >= rp.MaxTries {
+			return res, err
+		}
+
+		// If the server rejected the signature algorithm but accepts another
+		// algorithm which the key supports, re-sign immediately.
+		if c.negotiateAlgorithm(err, acct, key, alg) {
+			log.Debugf("retrying with negotiated signature algorithm after error: %v\n", err)
+			continue
+		}
+
+		t, serverRequested, retry := rp.retryAt(err, idempotent, tries)
+		if !retry {
+			return res, err
+		}
+
+		if serverRequested {
+			if t.Sub(defaultClock.Now()) > rp.MaxRetryAfter {
+				return res, &RetryAfterError{RetryAt: t, Err: err}
+			}
+			if deadline, ok := ctx.Deadline(); ok && t.After(deadline) {
+				return res, &RetryAfterError{RetryAt: t, Err: err}
 			}
 		}
 
-		// Other error, return.
-		return res, err
+		if errors.Is(err, ProblemBadNonce) {
+			c.nonceSource.CountBadNonceRetry()
+		}
+
+		log.Debugf("retrying after error: %v\n", err)
+		err = waitUntil(ctx, t)
+		if err != nil {
+			return res, err
+		}
 	}
 }
 
-func (c *RealmClient) doReqOneTry(ctx context.Context, method, url, accepts string, acct *Account, key crypto.PrivateKey, requestData, responseData interface{}) (*http.Response, error) {
+func (c *RealmClient) doReqOneTry(ctx context.Context, method, url, accepts string, acct *Account, key crypto.PrivateKey, alg jose.SignatureAlgorithm, requestData, responseData interface{}) (*http.Response, error) {
 	// Check input.
 	if !ValidURL(url) {
 		return nil, fmt.Errorf("invalid request URL: %q", url)
@@ -402,15 +639,6 @@ func (c *RealmClient) doReqOneTry(ctx context.Context, method, url, accepts stri
 			}
 		}
 
-		kalg, err := algorithmFromKey(key)
-		if err != nil {
-			return nil, err
-		}
-
-		signKey := jose.SigningKey{
-			Algorithm: kalg,
-			Key:       key,
-		}
 		extraHeaders := map[jose.HeaderKey]interface{}{
 			"url": url,
 		}
@@ -424,23 +652,11 @@ func (c *RealmClient) doReqOneTry(ctx context.Context, method, url, accepts stri
 			extraHeaders["kid"] = accountURL
 		}
 
-		signOptions := jose.SignerOptions{
+		s, err := signJWSBytes(key, alg, b, &jose.SignerOptions{
 			NonceSource:  c.nonceSource.WithContext(ctx),
 			EmbedJWK:     useInlineKey,
 			ExtraHeaders: extraHeaders,
-		}
-
-		signer, err := jose.NewSigner(signKey, &signOptions)
-		if err != nil {
-			return nil, err
-		}
-
-		sig, err := signer.Sign(b)
-		if err != nil {
-			return nil, err
-		}
-
-		s := sig.FullSerialize()
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -547,11 +763,54 @@ func (c *RealmClient) doReqActual(ctx context.Context, req *http.Request) (*http
 	return ctxhttp.Do(ctx, c.cfg.HTTPClient, req)
 }
 
-func algorithmFromKey(key crypto.PrivateKey) (jose.SignatureAlgorithm, error) {
-	switch v := key.(type) {
-	case *rsa.PrivateKey:
+// Signs the JSON serialization of payload with the given key, returning the
+// JWS in flattened JSON serialization.
+func signJWS(key crypto.PrivateKey, alg jose.SignatureAlgorithm, payload interface{}, opts *jose.SignerOptions) (string, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	return signJWSBytes(key, alg, b, opts)
+}
+
+// Signs payload with the given key using the signature algorithm alg. If alg
+// is empty, the default algorithm for the key is used.
+func signJWSBytes(key crypto.PrivateKey, alg jose.SignatureAlgorithm, payload []byte, opts *jose.SignerOptions) (string, error) {
+	sk, err := signingKeyFromKey(key, alg)
+	if err != nil {
+		return "", err
+	}
+
+	signer, err := jose.NewSigner(sk, opts)
+	if err != nil {
+		return "", err
+	}
+
+	sig, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+
+	return sig.FullSerialize(), nil
+}
+
+// Returns the public key corresponding to a private key.
+func publicKeyFromKey(key crypto.PrivateKey) (crypto.PublicKey, error) {
+	if s, ok := key.(crypto.Signer); ok {
+		return s.Public(), nil
+	}
+
+	return nil, fmt.Errorf("unsupported private key type: %T", key)
+}
+
+// Returns the default JWS signature algorithm used with the given public key,
+// which may be an RSA, ECDSA or Ed25519 key.
+func algorithmFromPublicKey(pub crypto.PublicKey) (jose.SignatureAlgorithm, error) {
+	switch v := pub.(type) {
+	case *rsa.PublicKey:
 		return jose.RS256, nil
-	case *ecdsa.PrivateKey:
+	case *ecdsa.PublicKey:
 		name := v.Curve.Params().Name
 		switch name {
 		case "P-256":
@@ -563,8 +822,10 @@ func algorithmFromKey(key crypto.PrivateKey) (jose.SignatureAlgorithm, error) {
 		default:
 			return "", fmt.Errorf("unsupported ECDSA curve: %s", name)
 		}
+	case ed25519.PublicKey:
+		return jose.EdDSA, nil
 	default:
-		return "", fmt.Errorf("unsupported private key type: %T", key)
+		return "", fmt.Errorf("unsupported public key type: %T", pub)
 	}
 }
 
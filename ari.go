@@ -0,0 +1,99 @@
+package acmeapi
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// Renewal information for a certificate, as provided by the ACME Renewal
+// Information (ARI) extension.
+type RenewalInfo struct {
+	// The window during which the CA suggests the certificate be renewed.
+	//
+	// Always sent by server.
+	SuggestedWindow RenewalWindow `json:"suggestedWindow"`
+
+	// An URL to a page explaining why the suggested window is what it is, for
+	// example because the certificate is to be revoked early.
+	//
+	// Optionally sent by server.
+	ExplanationURL string `json:"explanationURL,omitempty"`
+
+	// The time after which the renewal information should be requested again.
+	// Derived from the Retry-After header of the response, or set to a default
+	// if none was sent.
+	RetryAfter time.Time `json:"-"`
+}
+
+// A time window, for the purposes of renewal information.
+type RenewalWindow struct {
+	Start time.Time `json:"start"` // RFC 3339
+	End   time.Time `json:"end"`   // RFC 3339
+}
+
+// The time after which renewal information will be requested again if the
+// server does not specify otherwise.
+const defaultRenewalInfoPollTime = 6 * time.Hour
+
+// Calculates the ARI certificate identifier for a certificate. The identifier
+// is formed from the certificate's authority key identifier and serial number.
+// Returns an error if the certificate does not have an authority key
+// identifier.
+//
+// This identifier is used to request renewal information and as the value of
+// Order.Replaces.
+func RenewalCertID(cert *x509.Certificate) (string, error) {
+	if len(cert.AuthorityKeyId) == 0 {
+		return "", fmt.Errorf("certificate does not have an authority key identifier")
+	}
+
+	if cert.SerialNumber == nil || cert.SerialNumber.Sign() <= 0 {
+		return "", fmt.Errorf("certificate does not have a valid serial number")
+	}
+
+	// The serial number must be encoded as the content octets of a DER INTEGER,
+	// which means a leading zero octet is needed if the high bit is set.
+	serial := cert.SerialNumber.Bytes()
+	if serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(cert.AuthorityKeyId) + "." +
+		base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+// Retrieves renewal information for a certificate. The realm must support
+// the ACME Renewal Information extension.
+//
+// The request is not authenticated, so no account is required.
+func (c *RealmClient) GetRenewalInfo(ctx context.Context, cert *x509.Certificate) (*RenewalInfo, error) {
+	di, err := c.getDirectory(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if di.RenewalInfo == "" {
+		return nil, fmt.Errorf("endpoint does not support renewal information")
+	}
+
+	certID, err := RenewalCertID(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	ri := &RenewalInfo{}
+	res, err := c.doReq(ctx, "GET", di.renewalInfoURL(certID), nil, nil, nil, ri)
+	if err != nil {
+		return nil, err
+	}
+
+	if ri.SuggestedWindow.Start.IsZero() || ri.SuggestedWindow.End.Before(ri.SuggestedWindow.Start) {
+		return nil, fmt.Errorf("server returned invalid suggested renewal window")
+	}
+
+	ri.RetryAfter = retryAtDefault(res.Header, defaultRenewalInfoPollTime)
+	return ri, nil
+}
@@ -0,0 +1,124 @@
+package acmeapi
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"gopkg.in/square/go-jose.v2"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRenewalCertID(t *testing.T) {
+	aki, _ := hex.DecodeString("69885B6B87464041E1B37B847BA0AE2CDE01C8D4")
+	cert := &x509.Certificate{
+		AuthorityKeyId: aki,
+		SerialNumber:   big.NewInt(0x87654321),
+	}
+
+	certID, err := RenewalCertID(cert)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if certID != "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE" {
+		t.Fatalf("unexpected cert ID: %q", certID)
+	}
+
+	_, err = RenewalCertID(&x509.Certificate{SerialNumber: big.NewInt(1)})
+	if err == nil {
+		t.Fatal()
+	}
+}
+
+func TestGetRenewalInfo(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	ts.Directory["renewalInfo"] = ts.URL + "/renewal-info"
+	ts.Handle("/renewal-info/", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		if req.Method != "GET" || req.URL.Path != "/renewal-info/AQID.AQ" {
+			t.Errorf("unexpected request: %v %v", req.Method, req.URL.Path)
+		}
+
+		rw.Header().Set("Retry-After", "3600")
+		ts.writeJSON(rw, 200, map[string]interface{}{
+			"suggestedWindow": map[string]interface{}{
+				"start": "2025-01-02T04:00:00Z",
+				"end":   "2025-01-03T04:00:00Z",
+			},
+			"explanationURL": "https://acme.example.com/docs/ari",
+		})
+	})
+
+	withClock(clk, func() {
+		rc := ts.Client()
+		ri, err := rc.GetRenewalInfo(context.TODO(), &x509.Certificate{
+			AuthorityKeyId: []byte{1, 2, 3},
+			SerialNumber:   big.NewInt(1),
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		start, _ := time.Parse(time.RFC3339, "2025-01-02T04:00:00Z")
+		if !ri.SuggestedWindow.Start.Equal(start) || ri.SuggestedWindow.End.Sub(start) != 24*time.Hour {
+			t.Fatalf("unexpected window: %#v", ri.SuggestedWindow)
+		}
+		if ri.ExplanationURL != "https://acme.example.com/docs/ari" {
+			t.Fatalf("unexpected explanation URL: %q", ri.ExplanationURL)
+		}
+		if d := ri.RetryAfter.Sub(defaultClock.Now()); d != time.Hour {
+			t.Fatalf("unexpected retry time: %v", d)
+		}
+	})
+}
+
+func TestGetRenewalInfoMoved(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	// The renewalInfo URL may be given with a trailing slash.
+	ts.Directory["renewalInfo"] = ts.URL + "/renewal-info/"
+	ts.Handle("/renewal-info/", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		if req.URL.Path != "/renewal-info/AQID.AQ" {
+			t.Errorf("unexpected request: %v %v", req.Method, req.URL.Path)
+		}
+
+		ts.writeProblem(rw, 404, &Problem{Type: string(ProblemMalformed)})
+	})
+	ts.Handle("/renewal-info-2/", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		if req.URL.Path != "/renewal-info-2/AQID.AQ" {
+			t.Errorf("unexpected request: %v %v", req.Method, req.URL.Path)
+		}
+
+		ts.writeJSON(rw, 200, map[string]interface{}{
+			"suggestedWindow": map[string]interface{}{
+				"start": "2025-01-02T04:00:00Z",
+				"end":   "2025-01-03T04:00:00Z",
+			},
+		})
+	})
+
+	rc := ts.Client()
+	cert := &x509.Certificate{
+		AuthorityKeyId: []byte{1, 2, 3},
+		SerialNumber:   big.NewInt(1),
+	}
+	_, err := rc.GetRenewalInfo(context.TODO(), cert)
+	if err == nil {
+		t.Fatal()
+	}
+
+	// A 404 from the old endpoint refreshes the directory and the request is
+	// retried at the new endpoint.
+	ts.Directory["renewalInfo"] = ts.URL + "/renewal-info-2/"
+	ri, err := rc.GetRenewalInfo(context.TODO(), cert)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if ri.SuggestedWindow.Start.IsZero() {
+		t.Fatalf("unexpected renewal info: %#v", ri)
+	}
+}
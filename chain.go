@@ -0,0 +1,108 @@
+package acmeapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+)
+
+// Criteria used to select a preferred certificate chain from those offered
+// by a server. See SelectChain.
+type ChainPreference struct {
+	// If set, a chain matches if any of its issuing certificates has this
+	// subject common name, or if the last certificate in the chain was issued
+	// by a certificate with this subject common name. The latter allows a chain
+	// to be selected by the common name of its root, which is usually not
+	// included in the chain.
+	IssuerCommonName string
+
+	// If set, a chain matches if the SHA-256 hash of the DER-encoded
+	// SubjectPublicKeyInfo of any of its issuing certificates is equal to this
+	// value. Since the root is usually not included in the chain, a chain can
+	// only be selected by the public key of its root if the root is supplied in
+	// Roots.
+	IssuerSPKISHA256 []byte
+
+	// Optional. Root certificates which may have issued the last certificate in
+	// a chain. If the last certificate in a chain is signed by one of these,
+	// that root is treated as an issuing certificate of the chain when matching
+	// the criteria above.
+	Roots []*x509.Certificate
+}
+
+// Returns true iff the chain matches the preference. A chain matches if it
+// matches all of the criteria which are set. A preference with no criteria
+// set matches no chain.
+func (p *ChainPreference) Matches(chain *Certificate) bool {
+	if p.IssuerCommonName == "" && len(p.IssuerSPKISHA256) == 0 {
+		return false
+	}
+
+	for i, b := range chain.CertificateChain {
+		crt, err := x509.ParseCertificate(b)
+		if err != nil {
+			return false
+		}
+
+		if i > 0 && p.matchesIssuer(crt) {
+			return true
+		}
+
+		if i == len(chain.CertificateChain)-1 && p.matchesRoot(crt) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true iff the root which issued crt, the last certificate in a
+// chain, matches the preference.
+func (p *ChainPreference) matchesRoot(crt *x509.Certificate) bool {
+	for _, root := range p.Roots {
+		if bytes.Equal(crt.RawIssuer, root.RawSubject) && crt.CheckSignatureFrom(root) == nil && p.matchesIssuer(root) {
+			return true
+		}
+	}
+
+	// The root is usually not included in the chain, but the last certificate
+	// in the chain names it as its issuer.
+	return len(p.IssuerSPKISHA256) == 0 && crt.Issuer.CommonName == p.IssuerCommonName
+}
+
+func (p *ChainPreference) matchesIssuer(crt *x509.Certificate) bool {
+	if p.IssuerCommonName != "" && crt.Subject.CommonName != p.IssuerCommonName {
+		return false
+	}
+
+	if len(p.IssuerSPKISHA256) != 0 {
+		h := sha256.Sum256(crt.RawSubjectPublicKeyInfo)
+		if !bytes.Equal(h[:], p.IssuerSPKISHA256) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Selects a chain from a list of chains, such as that returned by
+// LoadCertificateChains. The preferences are tried in order; the first chain
+// matching the first preference which matches any chain is returned. If no
+// preference matches any chain, or no preferences are given, the first chain
+// (the server's default chain) is returned. Returns nil only if chains is
+// empty.
+func SelectChain(chains []*Certificate, prefs ...ChainPreference) *Certificate {
+	if len(chains) == 0 {
+		return nil
+	}
+
+	for i := range prefs {
+		for _, chain := range chains {
+			if prefs[i].Matches(chain) {
+				return chain
+			}
+		}
+	}
+
+	return chains[0]
+}
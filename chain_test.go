@@ -0,0 +1,134 @@
+package acmeapi
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"gopkg.in/hlandau/acmeapi.v2/acmeutils"
+	"gopkg.in/square/go-jose.v2"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestCert(t *testing.T, cn string, key *ecdsa.PrivateKey, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) *x509.Certificate {
+	tpl := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: cn},
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil || cn != "leaf",
+	}
+	if parent == nil {
+		parent, parentKey = tpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("cannot parse certificate: %v", err)
+	}
+
+	return crt
+}
+
+func TestSelectChain(t *testing.T) {
+	rootAKey, rootBKey, intAKey, intBKey, leafKey := newTestKey(t), newTestKey(t), newTestKey(t), newTestKey(t), newTestKey(t)
+	rootA := newTestCert(t, "Root A", rootAKey, nil, nil)
+	rootB := newTestCert(t, "Root B", rootBKey, nil, nil)
+	intA := newTestCert(t, "Intermediate A", intAKey, rootA, rootAKey)
+	intB := newTestCert(t, "Intermediate B", intBKey, rootB, rootBKey)
+	leafA := newTestCert(t, "leaf", leafKey, intA, intAKey)
+	leafB := newTestCert(t, "leaf", leafKey, intB, intBKey)
+
+	chainA := &Certificate{CertificateChain: [][]byte{leafA.Raw, intA.Raw}}
+	chainB := &Certificate{CertificateChain: [][]byte{leafB.Raw, intB.Raw}}
+	chains := []*Certificate{chainA, chainB}
+
+	if SelectChain(nil) != nil {
+		t.Fatal()
+	}
+	if SelectChain(chains) != chainA {
+		t.Fatal()
+	}
+	if SelectChain(chains, ChainPreference{IssuerCommonName: "Root B"}) != chainB {
+		t.Fatal()
+	}
+	if SelectChain(chains, ChainPreference{IssuerCommonName: "Intermediate B"}) != chainB {
+		t.Fatal()
+	}
+	if SelectChain(chains, ChainPreference{IssuerCommonName: "leaf"}) != chainA {
+		t.Fatal()
+	}
+
+	h := sha256.Sum256(intB.RawSubjectPublicKeyInfo)
+	if SelectChain(chains, ChainPreference{IssuerCommonName: "Root C"}, ChainPreference{IssuerSPKISHA256: h[:]}) != chainB {
+		t.Fatal()
+	}
+	if SelectChain(chains, ChainPreference{IssuerCommonName: "Intermediate A", IssuerSPKISHA256: h[:]}) != chainA {
+		t.Fatal()
+	}
+
+	// Roots are not in the chain, so can only be matched by public key if
+	// they are supplied.
+	h = sha256.Sum256(rootB.RawSubjectPublicKeyInfo)
+	if SelectChain(chains, ChainPreference{IssuerSPKISHA256: h[:]}) != chainA {
+		t.Fatal()
+	}
+	if SelectChain(chains, ChainPreference{IssuerSPKISHA256: h[:], Roots: []*x509.Certificate{rootA, rootB}}) != chainB {
+		t.Fatal()
+	}
+	if SelectChain(chains, ChainPreference{IssuerCommonName: "Root B", IssuerSPKISHA256: h[:], Roots: []*x509.Certificate{rootB}}) != chainB {
+		t.Fatal()
+	}
+
+	// A root with the same name which did not issue the chain does not match.
+	rootB2 := newTestCert(t, "Root B", newTestKey(t), nil, nil)
+	h = sha256.Sum256(rootB2.RawSubjectPublicKeyInfo)
+	if SelectChain(chains, ChainPreference{IssuerSPKISHA256: h[:], Roots: []*x509.Certificate{rootB2}}) != chainA {
+		t.Fatal()
+	}
+}
+
+func TestLoadCertificateChains(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	key := newTestKey(t)
+	rootA := newTestCert(t, "Root A", key, nil, nil)
+	rootB := newTestCert(t, "Root B", key, nil, nil)
+
+	ts.Handle("/cert/", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		crt := rootA
+		if req.URL.Path == "/cert/1" {
+			rw.Header().Add("Link", `</cert/1/alt>;rel="alternate"`)
+		} else {
+			crt = rootB
+		}
+
+		rw.Header().Set("Content-Type", "application/pem-certificate-chain")
+		acmeutils.SaveCertificates(rw, crt.Raw)
+	})
+
+	rc := ts.Client()
+	chains, err := rc.LoadCertificateChains(context.TODO(), &Account{URL: ts.URL + "/acct/1", PrivateKey: key}, &Certificate{URL: ts.URL + "/cert/1"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if len(chains) != 2 || chains[1].URL != ts.URL+"/cert/1/alt" || len(chains[0].AlternateURLs) != 1 {
+		t.Fatalf("unexpected chains: %#v", chains)
+	}
+	if SelectChain(chains, ChainPreference{IssuerCommonName: "Root B"}) != chains[1] {
+		t.Fatal()
+	}
+}
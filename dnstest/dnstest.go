@@ -0,0 +1,262 @@
+// Package dnstest provides a minimal in-process DNS server for use in tests.
+package dnstest
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A minimal in-process authoritative DNS server used as a stand-in for a
+// real nameserver in tests. It serves SOA, TXT and CNAME records for the
+// zones it is configured with, as well as NS and A records for the
+// nameservers of those zones, and accepts RFC 2136 updates to TXT records.
+type Server struct {
+	// The address of the server in "host:port" form.
+	Addr string
+
+	srv        *dns.Server
+	tsigSecret map[string]string
+
+	mutex  sync.Mutex
+	zones  map[string]struct{}
+	txt    map[string][]string
+	cnames map[string]string
+	ns     map[string][]string
+	a      map[string]string
+}
+
+// Starts a server listening on UDP on the loopback interface, which is
+// authoritative for the given zones. If tsigSecret is non-nil, updates must
+// be signed using one of the given TSIG keys.
+func NewServer(t *testing.T, tsigSecret map[string]string, zones ...string) *Server {
+	return NewServerNet(t, "udp", tsigSecret, zones...)
+}
+
+// Like NewServer, but listens only on the given network, "udp" or "tcp".
+func NewServerNet(t *testing.T, network string, tsigSecret map[string]string, zones ...string) *Server {
+	var pc net.PacketConn
+	var l net.Listener
+	var addr string
+	var err error
+	if network == "tcp" {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+		if err == nil {
+			addr = l.Addr().String()
+		}
+	} else {
+		pc, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err == nil {
+			addr = pc.LocalAddr().String()
+		}
+	}
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+
+	s := &Server{
+		Addr:       addr,
+		tsigSecret: tsigSecret,
+		zones:      map[string]struct{}{},
+		txt:        map[string][]string{},
+		cnames:     map[string]string{},
+		ns:         map[string][]string{},
+		a:          map[string]string{},
+	}
+	for _, z := range zones {
+		s.zones[dns.Fqdn(z)] = struct{}{}
+	}
+
+	started := make(chan struct{})
+	s.srv = &dns.Server{
+		PacketConn:        pc,
+		Listener:          l,
+		Handler:           s,
+		TsigSecret:        tsigSecret,
+		NotifyStartedFunc: func() { close(started) },
+		MsgAcceptFunc: func(dh dns.Header) dns.MsgAcceptAction {
+			return dns.MsgAccept
+		},
+	}
+
+	go s.srv.ActivateAndServe()
+	<-started
+	return s
+}
+
+// Stops the server.
+func (s *Server) Close() {
+	s.srv.Shutdown()
+}
+
+// Returns the TXT records for the given name.
+func (s *Server) TXT(name string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.txt[dns.Fqdn(name)]...)
+}
+
+// Sets the TXT records for the given name.
+func (s *Server) SetTXT(name string, values ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.txt[dns.Fqdn(name)] = values
+}
+
+// Sets the nameservers for a zone, given as a map from nameserver hostnames to
+// their IPv4 addresses.
+func (s *Server) SetNS(zone string, nameservers map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	zone = dns.Fqdn(zone)
+	s.ns[zone] = nil
+	for name, ip := range nameservers {
+		s.ns[zone] = append(s.ns[zone], dns.Fqdn(name))
+		s.a[dns.Fqdn(name)] = ip
+	}
+}
+
+// Sets a CNAME record for the given name.
+func (s *Server) SetCNAME(name, target string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cnames[dns.Fqdn(name)] = dns.Fqdn(target)
+}
+
+// Returns the zone containing name, or "" if the server is not authoritative
+// for name.
+func (s *Server) zoneOf(name string) string {
+	for {
+		if _, ok := s.zones[name]; ok {
+			return name
+		}
+
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return ""
+		}
+
+		name = name[i+1:]
+	}
+}
+
+func (s *Server) soa(zone string) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+		Ns:      "ns1." + zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  60,
+	}
+}
+
+// Implements dns.Handler.
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.Authoritative = true
+
+	if len(req.Question) != 1 {
+		res.Rcode = dns.RcodeFormatError
+		w.WriteMsg(res)
+		return
+	}
+
+	q := req.Question[0]
+	qname := strings.ToLower(q.Name)
+	zone := s.zoneOf(qname)
+
+	switch {
+	case zone == "":
+		res.Rcode = dns.RcodeRefused
+
+	case req.Opcode == dns.OpcodeUpdate:
+		if zone != qname {
+			res.Rcode = dns.RcodeNotZone
+			break
+		}
+
+		if s.tsigSecret != nil && (req.IsTsig() == nil || w.TsigStatus() != nil) {
+			res.Rcode = dns.RcodeRefused
+			break
+		}
+
+		for _, rr := range req.Ns {
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				res.Rcode = dns.RcodeNotImplemented
+				break
+			}
+
+			name := strings.ToLower(txt.Hdr.Name)
+			switch txt.Hdr.Class {
+			case dns.ClassINET:
+				s.txt[name] = append(s.txt[name], strings.Join(txt.Txt, ""))
+			case dns.ClassNONE:
+				var values []string
+				for _, v := range s.txt[name] {
+					if v != strings.Join(txt.Txt, "") {
+						values = append(values, v)
+					}
+				}
+				s.txt[name] = values
+			}
+		}
+
+		if t := req.IsTsig(); t != nil {
+			res.SetTsig(t.Hdr.Name, t.Algorithm, 300, time.Now().Unix())
+		}
+
+	default:
+		if target, ok := s.cnames[qname]; ok {
+			res.Answer = append(res.Answer, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: qname, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+				Target: target,
+			})
+			break
+		}
+
+		switch q.Qtype {
+		case dns.TypeSOA:
+			if zone == qname {
+				res.Answer = append(res.Answer, s.soa(zone))
+			}
+		case dns.TypeNS:
+			for _, ns := range s.ns[qname] {
+				res.Answer = append(res.Answer, &dns.NS{
+					Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60},
+					Ns:  ns,
+				})
+			}
+		case dns.TypeA:
+			if ip, ok := s.a[qname]; ok {
+				res.Answer = append(res.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP(ip),
+				})
+			}
+		case dns.TypeTXT:
+			for _, v := range s.txt[qname] {
+				res.Answer = append(res.Answer, &dns.TXT{
+					Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+					Txt: []string{v},
+				})
+			}
+		}
+
+		if len(res.Answer) == 0 {
+			res.Ns = append(res.Ns, s.soa(zone))
+		}
+	}
+
+	w.WriteMsg(res)
+}
@@ -0,0 +1,10 @@
+package acmeapi
+
+// Test helpers made available to tests in package acmeapi_test, which can
+// import packages, such as acmehttp01 and acmedns01, which themselves import
+// this package.
+var (
+	NewTestServer   = newTestServer
+	NewTestKey      = newTestKey
+	HandleTestOrder = handleTestOrder
+)
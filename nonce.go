@@ -4,8 +4,59 @@ import (
 	"context"
 	"errors"
 	"sync"
+	"time"
 )
 
+// Configures the pool of nonces kept by a RealmClient. Nonces are returned by
+// the server with every response and are consumed by signed requests; a
+// request for a fresh nonce is only made when the pool is empty.
+//
+// The zero value is a usable default configuration.
+type NoncePoolConfig struct {
+	// Maximum number of nonces kept in the pool. When the pool is full, the
+	// oldest nonce is discarded. Defaults to 32.
+	MaxSize int
+
+	// If non-zero, nonces older than this are discarded rather than used, as
+	// the server is likely to reject them.
+	MaxAge time.Duration
+
+	// If non-zero, whenever a nonce is taken from the pool and fewer than this
+	// many nonces remain, further nonces are requested in the background until
+	// the pool contains this many. This avoids signed requests having to wait
+	// for a nonce to be fetched under concurrent use.
+	PrefetchThreshold int
+}
+
+// Counters describing the use of the nonce pool of a RealmClient.
+type NonceStats struct {
+	// Number of nonces taken from the pool.
+	Hits uint64
+
+	// Number of times the pool was empty, so that a nonce had to be requested
+	// before a signed request could be made.
+	Misses uint64
+
+	// Number of requests retried because the server rejected the nonce used.
+	BadNonceRetries uint64
+
+	// Number of nonces discarded unused because the pool was full.
+	Discarded uint64
+
+	// Number of nonces discarded unused because they were older than MaxAge.
+	Expired uint64
+}
+
+const defaultNoncePoolSize = 32
+
+// Maximum time taken by a background nonce prefetch.
+const noncePrefetchTimeout = 30 * time.Second
+
+type pooledNonce struct {
+	nonce string
+	added time.Time
+}
+
 // Stores a pool of nonces used to make replay-proof requests.
 type nonceSource struct {
 	// If set, called when the nonce store is exhausted and a nonce is requested.
@@ -15,28 +66,28 @@ type nonceSource struct {
 	// to retrieve a nonce.
 	GetNonceFunc func(ctx context.Context) error
 
-	initOnce  sync.Once
-	pool      map[string]struct{}
-	poolMutex sync.Mutex
-}
+	// Limits on the pool. See NoncePoolConfig.
+	Config NoncePoolConfig
 
-func (ns *nonceSource) init() {
-	ns.initOnce.Do(func() {
-		ns.pool = map[string]struct{}{}
-	})
+	pool        []pooledNonce // Oldest first.
+	poolMutex   sync.Mutex
+	prefetching bool
+	stats       NonceStats
 }
 
 // Retrieves a new nonce. If no nonces remain in the pool, GetNonceFunc is used
 // if possible to retrieve a new one. This may result in network I/O, hence the
 // ctx parameter.
 func (ns *nonceSource) Nonce(ctx context.Context) (string, error) {
-	ns.init()
-
 	k := ns.tryPop()
 	if k != "" {
 		return k, nil
 	}
 
+	ns.poolMutex.Lock()
+	ns.stats.Misses++
+	ns.poolMutex.Unlock()
+
 	err := ns.obtainNonce(ctx)
 	if err != nil {
 		return "", err
@@ -54,12 +105,65 @@ func (ns *nonceSource) tryPop() string {
 	ns.poolMutex.Lock()
 	defer ns.poolMutex.Unlock()
 
-	for k := range ns.pool {
-		delete(ns.pool, k)
-		return k
+	ns.expire()
+	if len(ns.pool) == 0 {
+		return ""
+	}
+
+	// Use the most recently received nonce, as it is the least likely to have
+	// expired.
+	k := ns.pool[len(ns.pool)-1].nonce
+	ns.pool = ns.pool[0 : len(ns.pool)-1]
+	ns.stats.Hits++
+
+	if len(ns.pool) < ns.Config.PrefetchThreshold && ns.GetNonceFunc != nil && !ns.prefetching {
+		ns.prefetching = true
+		go ns.prefetch()
+	}
+
+	return k
+}
+
+// Discards expired nonces. Must be called with the mutex held.
+func (ns *nonceSource) expire() {
+	if ns.Config.MaxAge == 0 {
+		return
 	}
 
-	return ""
+	cutoff := defaultClock.Now().Add(-ns.Config.MaxAge)
+	i := 0
+	for i < len(ns.pool) && ns.pool[i].added.Before(cutoff) {
+		i++
+	}
+
+	ns.pool = ns.pool[i:]
+	ns.stats.Expired += uint64(i)
+}
+
+// Requests nonces until the pool reaches the prefetch threshold.
+func (ns *nonceSource) prefetch() {
+	defer func() {
+		ns.poolMutex.Lock()
+		defer ns.poolMutex.Unlock()
+		ns.prefetching = false
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), noncePrefetchTimeout)
+	defer cancel()
+
+	for i := 0; i < ns.Config.PrefetchThreshold && ns.size() < ns.Config.PrefetchThreshold; i++ {
+		err := ns.obtainNonce(ctx)
+		if err != nil {
+			log.Debugf("failed to prefetch nonce: %v", err)
+			return
+		}
+	}
+}
+
+func (ns *nonceSource) size() int {
+	ns.poolMutex.Lock()
+	defer ns.poolMutex.Unlock()
+	return len(ns.pool)
 }
 
 func (ns *nonceSource) obtainNonce(ctx context.Context) error {
@@ -71,12 +175,42 @@ func (ns *nonceSource) obtainNonce(ctx context.Context) error {
 }
 
 // Add a nonce to the pool. This is a no-op if the nonce is already in the
-// pool.
+// pool. If the pool is full, the oldest nonce is discarded.
 func (ns *nonceSource) AddNonce(nonce string) {
-	ns.init()
 	ns.poolMutex.Lock()
 	defer ns.poolMutex.Unlock()
-	ns.pool[nonce] = struct{}{}
+
+	for _, pn := range ns.pool {
+		if pn.nonce == nonce {
+			return
+		}
+	}
+
+	maxSize := ns.Config.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultNoncePoolSize
+	}
+	if len(ns.pool) >= maxSize {
+		n := len(ns.pool) - maxSize + 1
+		ns.pool = ns.pool[n:]
+		ns.stats.Discarded += uint64(n)
+	}
+
+	ns.pool = append(ns.pool, pooledNonce{nonce, defaultClock.Now()})
+}
+
+// Records that a request was retried because its nonce was rejected.
+func (ns *nonceSource) CountBadNonceRetry() {
+	ns.poolMutex.Lock()
+	defer ns.poolMutex.Unlock()
+	ns.stats.BadNonceRetries++
+}
+
+// Returns the current values of the pool counters.
+func (ns *nonceSource) Stats() NonceStats {
+	ns.poolMutex.Lock()
+	defer ns.poolMutex.Unlock()
+	return ns.stats
 }
 
 // Returns a struct with a single method, Nonce() which can be called to obtain
@@ -2,7 +2,9 @@ package acmeapi
 
 import (
 	"context"
+	"fmt"
 	"testing"
+	"time"
 )
 
 func TestNonce(t *testing.T) {
@@ -35,3 +37,99 @@ func TestNonce(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestNoncePoolLimits(t *testing.T) {
+	ns := nonceSource{
+		Config: NoncePoolConfig{
+			MaxSize: 3,
+		},
+	}
+
+	for _, n := range []string{"n1", "n2", "n3", "n3", "n4", "n5"} {
+		ns.AddNonce(n)
+	}
+
+	// n1 and n2 were discarded because the pool was full.
+	for _, expected := range []string{"n5", "n4", "n3"} {
+		n, err := ns.Nonce(context.TODO())
+		if err != nil || n != expected {
+			t.Fatalf("unexpected nonce: %q %v (expected %q)", n, err, expected)
+		}
+	}
+
+	n, err := ns.Nonce(context.TODO())
+	if err == nil {
+		t.Fatalf("expected pool to be empty, got %q", n)
+	}
+
+	if s := ns.Stats(); s.Hits != 3 || s.Misses != 1 || s.Discarded != 2 || s.Expired != 0 {
+		t.Fatalf("unexpected stats: %#v", s)
+	}
+}
+
+func TestNonceMaxAge(t *testing.T) {
+	withClock(slowClk, func() {
+		ns := nonceSource{
+			Config: NoncePoolConfig{
+				MaxAge: time.Minute,
+			},
+		}
+
+		ns.AddNonce("n1")
+		slowClk.Advance(50 * time.Second)
+		ns.AddNonce("n2")
+		slowClk.Advance(20 * time.Second)
+
+		n, err := ns.Nonce(context.TODO())
+		if err != nil || n != "n2" {
+			t.Fatalf("unexpected nonce: %q %v", n, err)
+		}
+
+		// n1 has expired.
+		n, err = ns.Nonce(context.TODO())
+		if err == nil {
+			t.Fatalf("expected pool to be empty, got %q", n)
+		}
+
+		if s := ns.Stats(); s.Hits != 1 || s.Misses != 1 || s.Discarded != 0 || s.Expired != 1 {
+			t.Fatalf("unexpected stats: %#v", s)
+		}
+	})
+}
+
+func TestNoncePrefetch(t *testing.T) {
+	var ns nonceSource
+	fetched := make(chan struct{}, 10)
+	var counter int
+	ns.GetNonceFunc = func(ctx context.Context) error {
+		counter++
+		ns.AddNonce(fmt.Sprintf("nonce-%d", counter))
+		fetched <- struct{}{}
+		return nil
+	}
+	ns.Config.PrefetchThreshold = 2
+
+	ns.AddNonce("a")
+	n, err := ns.Nonce(context.TODO())
+	if err != nil || n != "a" {
+		t.Fatalf("unexpected nonce: %q %v", n, err)
+	}
+
+	// The pool is refilled in the background. fetched is signalled only once
+	// each nonce has been added to the pool.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-fetched:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("nonces not prefetched")
+		}
+	}
+
+	if ns.size() != 2 {
+		t.Fatalf("unexpected pool size: %d", ns.size())
+	}
+
+	if s := ns.Stats(); s.Hits != 1 || s.Misses != 0 {
+		t.Fatalf("unexpected stats: %#v", s)
+	}
+}
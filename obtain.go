@@ -0,0 +1,248 @@
+package acmeapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/hlandau/acmeapi.v2/acmeutils"
+	"sync"
+)
+
+// A ChallengeSolver arranges for a challenge of a particular type to be
+// satisfiable, for example by provisioning an HTTP resource or a DNS record,
+// and later removes whatever it provisioned.
+type ChallengeSolver interface {
+	// Returns the challenge type this solver handles, e.g. "http-01".
+	ChallengeType() string
+
+	// Makes the response to the challenge available. Called before the server
+	// is asked to validate the challenge.
+	Present(ctx context.Context, acct *Account, az *Authorization, ch *Challenge) error
+
+	// Removes anything provisioned by Present. Called once validation has
+	// finished, whether or not it succeeded.
+	CleanUp(ctx context.Context, acct *Account, az *Authorization, ch *Challenge) error
+}
+
+// Answers tls-alpn-01 challenges using an acmeutils.TLSALPNResponder, which
+// must be serving TLS connections on port 443 of the hosts being validated.
+// Implements ChallengeSolver.
+type TLSALPNSolver struct {
+	// Required. Answers the validation handshakes.
+	Responder *acmeutils.TLSALPNResponder
+}
+
+// Implements ChallengeSolver.
+func (s *TLSALPNSolver) ChallengeType() string {
+	return "tls-alpn-01"
+}
+
+// Implements ChallengeSolver.
+func (s *TLSALPNSolver) Present(ctx context.Context, acct *Account, az *Authorization, ch *Challenge) error {
+	return s.Responder.Add(acct.PrivateKey, ch.Token, az.Identifier.Value)
+}
+
+// Implements ChallengeSolver.
+func (s *TLSALPNSolver) CleanUp(ctx context.Context, acct *Account, az *Authorization, ch *Challenge) error {
+	s.Responder.Remove(az.Identifier.Value)
+	return nil
+}
+
+// Obtains a certificate for the given identifiers. This is a convenience
+// method which performs the entire issuance process:
+//
+//   - an order is created for the identifiers;
+//   - all of the order's authorizations are loaded;
+//   - for each pending authorization, a challenge is chosen, presented using
+//     its solver, responded to and polled until the authorization reaches a
+//     final state, after which the solver cleans up;
+//   - the order is finalized with the DER-encoded CSR, which must contain the
+//     identifiers;
+//   - the certificate is downloaded once issued.
+//
+// The solvers are given in order of preference. For each authorization, the
+// challenge handled by the first solver for which the authorization offers a
+// challenge is used. Authorizations which are already valid are not solved
+// again. Solvers for the common challenge types are provided by
+// acmehttp01.Solver, acmedns01.Solver and TLSALPNSolver.
+func (c *RealmClient) Obtain(ctx context.Context, acct *Account, identifiers []Identifier, csr []byte, solvers []ChallengeSolver) (*Certificate, error) {
+	order := &Order{
+		Identifiers: identifiers,
+	}
+
+	err := c.NewOrder(ctx, acct, order)
+	if err != nil {
+		return nil, err
+	}
+
+	azs, err := c.loadAuthorizations(ctx, acct, order)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.solveAuthorizations(ctx, acct, azs, solvers)
+	if err != nil {
+		return nil, err
+	}
+
+	// The order becomes ready asynchronously once its authorizations are valid.
+	for order.Status == OrderPending {
+		err = c.WaitLoadOrder(ctx, acct, order)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if order.Status != OrderReady {
+		return nil, orderFailedError(order)
+	}
+
+	err = c.Finalize(ctx, acct, order, csr)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.WaitForOrder(ctx, acct, order)
+	if err != nil {
+		return nil, err
+	}
+
+	if order.Status != OrderValid {
+		return nil, orderFailedError(order)
+	}
+
+	cert := &Certificate{
+		URL: order.CertificateURL,
+	}
+
+	err = c.LoadCertificate(ctx, acct, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+func orderFailedError(order *Order) error {
+	if order.Error != nil {
+		return fmt.Errorf("order %q has status %q: %v", order.URL, order.Status, order.Error)
+	}
+
+	return fmt.Errorf("order %q has status %q", order.URL, order.Status)
+}
+
+// Loads all authorizations of an order concurrently.
+func (c *RealmClient) loadAuthorizations(ctx context.Context, acct *Account, order *Order) ([]*Authorization, error) {
+	azs := make([]*Authorization, len(order.AuthorizationURLs))
+	errs := make([]error, len(order.AuthorizationURLs))
+
+	var wg sync.WaitGroup
+	for i, azURL := range order.AuthorizationURLs {
+		azs[i] = &Authorization{URL: azURL}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.LoadAuthorization(ctx, acct, azs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return azs, nil
+}
+
+// Solves all pending authorizations concurrently. If any authorization cannot
+// be solved, the others are abandoned and the first error is returned.
+func (c *RealmClient) solveAuthorizations(ctx context.Context, acct *Account, azs []*Authorization, solvers []ChallengeSolver) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chs := make([]*Challenge, len(azs))
+	chSolvers := make([]ChallengeSolver, len(azs))
+	for i, az := range azs {
+		switch az.Status {
+		case AuthorizationValid:
+			continue
+		case AuthorizationPending:
+		default:
+			return fmt.Errorf("authorization for %v has status %q", &az.Identifier, az.Status)
+		}
+
+		chs[i], chSolvers[i] = chooseChallenge(az, solvers)
+		if chs[i] == nil {
+			return fmt.Errorf("no solver for any challenge offered for %v", &az.Identifier)
+		}
+	}
+
+	errs := make([]error, len(azs))
+
+	var wg sync.WaitGroup
+	for i := range azs {
+		if chs[i] == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.solveAuthorization(ctx, acct, azs[i], chs[i], chSolvers[i])
+			if errs[i] != nil {
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Prefer an error other than the cancellation caused by another failure.
+	var firstErr error
+	for _, err := range errs {
+		if err != nil && (firstErr == nil || firstErr == context.Canceled) {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Returns a copy of the pending challenge of the authorization handled by the
+// most preferred solver, or nil if there is no such challenge.
+func chooseChallenge(az *Authorization, solvers []ChallengeSolver) (*Challenge, ChallengeSolver) {
+	for _, solver := range solvers {
+		for i := range az.Challenges {
+			ch := az.Challenges[i]
+			if ch.Type == solver.ChallengeType() && ch.Status == ChallengePending {
+				return &ch, solver
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func (c *RealmClient) solveAuthorization(ctx context.Context, acct *Account, az *Authorization, ch *Challenge, solver ChallengeSolver) error {
+	err := solver.Present(ctx, acct, az, ch)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		// Clean up even if ctx has been cancelled.
+		err := solver.CleanUp(context.Background(), acct, az, ch)
+		if err != nil {
+			log.Errorf("failed to clean up challenge for %v: %v", &az.Identifier, err)
+		}
+	}()
+
+	err = c.RespondToChallenge(ctx, acct, ch, json.RawMessage(`{}`))
+	if err != nil {
+		return err
+	}
+
+	return c.WaitForAuthorization(ctx, acct, az)
+}
@@ -0,0 +1,132 @@
+package acmeapi_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"gopkg.in/hlandau/acmeapi.v2"
+	"gopkg.in/hlandau/acmeapi.v2/acmedns01"
+	"gopkg.in/hlandau/acmeapi.v2/acmehttp01"
+	"gopkg.in/hlandau/acmeapi.v2/acmeutils"
+	"gopkg.in/hlandau/acmeapi.v2/dnstest"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testIdentifiers = []acmeapi.Identifier{
+	{Type: acmeapi.IdentifierTypeDNS, Value: "a.example.com"},
+	{Type: acmeapi.IdentifierTypeDNS, Value: "b.example.com"},
+}
+
+func TestObtainHTTP01(t *testing.T) {
+	ts := acmeapi.NewTestServer(t)
+	defer ts.Close()
+
+	store := &acmehttp01.Store{}
+	web := httptest.NewServer(store)
+	defer web.Close()
+
+	acct := &acmeapi.Account{URL: ts.URL + "/acct/1", PrivateKey: acmeapi.NewTestKey(t)}
+	acmeapi.HandleTestOrder(ts, func(chType, token string) error {
+		if chType != "http-01" {
+			return fmt.Errorf("unexpected challenge type: %q", chType)
+		}
+
+		res, err := http.Get(web.URL + acmehttp01.WellKnownPath + token)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+
+		ka, err := acmeutils.KeyAuthorization(acct.PrivateKey, token)
+		if err != nil {
+			return err
+		}
+
+		if res.StatusCode != 200 || string(b) != ka {
+			return fmt.Errorf("incorrect key authorization: %d %q", res.StatusCode, b)
+		}
+
+		return nil
+	})
+
+	solvers := []acmeapi.ChallengeSolver{&acmehttp01.Solver{Responder: store}}
+	cert, err := ts.Client().Obtain(context.TODO(), acct, testIdentifiers, []byte{1, 2, 3}, solvers)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if cert.URL != ts.URL+"/cert/1" {
+		t.Fatalf("unexpected certificate URL: %q", cert.URL)
+	}
+
+	if _, ok := store.Get("http"); ok {
+		t.Fatalf("challenge not cleaned up")
+	}
+}
+
+func TestObtainDNS01(t *testing.T) {
+	ts := acmeapi.NewTestServer(t)
+	defer ts.Close()
+
+	s := dnstest.NewServer(t, nil, "example.com")
+	defer s.Close()
+
+	_, port, _ := net.SplitHostPort(s.Addr)
+	s.SetNS("example.com", map[string]string{"ns1.example.com": "127.0.0.1"})
+
+	acct := &acmeapi.Account{URL: ts.URL + "/acct/1", PrivateKey: acmeapi.NewTestKey(t)}
+	acmeapi.HandleTestOrder(ts, func(chType, token string) error {
+		if chType != "dns-01" {
+			return fmt.Errorf("unexpected challenge type: %q", chType)
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion("_acme-challenge.a.example.com.", dns.TypeTXT)
+		res, _, err := new(dns.Client).Exchange(m, s.Addr)
+		if err != nil {
+			return err
+		}
+
+		value, err := acmeutils.DNSKeyAuthorization(acct.PrivateKey, token)
+		if err != nil {
+			return err
+		}
+
+		for _, rr := range res.Answer {
+			if txt, ok := rr.(*dns.TXT); ok && len(txt.Txt) == 1 && txt.Txt[0] == value {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("no TXT record with value %q", value)
+	})
+
+	solvers := []acmeapi.ChallengeSolver{&acmedns01.Solver{
+		Provider: &acmedns01.RFC2136{Nameserver: s.Addr},
+		PropagationChecker: &acmedns01.PropagationChecker{
+			Resolver:       s.Addr,
+			Interval:       10 * time.Millisecond,
+			NameserverPort: port,
+		},
+	}}
+	cert, err := ts.Client().Obtain(context.TODO(), acct, testIdentifiers, []byte{1, 2, 3}, solvers)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if cert.URL != ts.URL+"/cert/1" {
+		t.Fatalf("unexpected certificate URL: %q", cert.URL)
+	}
+
+	if txt := s.TXT("_acme-challenge.a.example.com"); len(txt) != 0 {
+		t.Fatalf("challenge not cleaned up: %v", txt)
+	}
+}
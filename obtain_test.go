@@ -0,0 +1,296 @@
+package acmeapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"gopkg.in/hlandau/acmeapi.v2/acmeutils"
+	"gopkg.in/square/go-jose.v2"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testSolver struct {
+	challengeType string
+
+	mutex     sync.Mutex
+	presented map[string]bool
+	cleanedUp map[string]bool
+}
+
+func (s *testSolver) ChallengeType() string {
+	return s.challengeType
+}
+
+func (s *testSolver) Present(ctx context.Context, acct *Account, az *Authorization, ch *Challenge) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.presented[ch.Token] = true
+	return nil
+}
+
+func (s *testSolver) CleanUp(ctx context.Context, acct *Account, az *Authorization, ch *Challenge) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cleanedUp[ch.Token] = true
+	return nil
+}
+
+func newTestSolver(challengeType string) *testSolver {
+	return &testSolver{
+		challengeType: challengeType,
+		presented:     map[string]bool{},
+		cleanedUp:     map[string]bool{},
+	}
+}
+
+// A test challenge offered by handleTestOrder.
+type testChallenge struct {
+	Type, Path, Token string
+}
+
+var testChallenges = []testChallenge{
+	{"http-01", "/chall/1", "http"},
+	{"dns-01", "/chall/2", "dns"},
+	{"tls-alpn-01", "/chall/3", "tls-alpn"},
+}
+
+// Serves an order with two authorizations, the first of which, for
+// a.example.com, is pending and the second of which is already valid. When a
+// challenge of the first is responded to, validate is called with its type
+// and token; validation succeeds iff it returns nil.
+func handleTestOrder(ts *testServer, validate func(chType, token string) error) {
+	key := newTestKey(ts.t)
+	crt := newTestCert(ts.t, "leaf", key, nil, nil)
+
+	var mutex sync.Mutex
+	azStatus := "pending"
+	chPath := "" // The challenge responded to.
+	chStatus := "pending"
+	orderStatus := "pending"
+	var validationErr error
+
+	writeAuthz := func(rw http.ResponseWriter) {
+		var chs []interface{}
+		for _, tc := range testChallenges {
+			ch := map[string]interface{}{"type": tc.Type, "url": ts.URL + tc.Path, "status": "pending", "token": tc.Token}
+			if tc.Path == chPath {
+				ch["status"] = chStatus
+				if chStatus == "invalid" {
+					ch["error"] = map[string]interface{}{"type": "urn:ietf:params:acme:error:incorrectResponse", "detail": validationErr.Error()}
+				}
+			}
+			chs = append(chs, ch)
+		}
+
+		rw.Header().Set("Retry-After", "0")
+		ts.writeJSON(rw, 200, map[string]interface{}{
+			"identifier": map[string]interface{}{"type": "dns", "value": "a.example.com"},
+			"status":     azStatus,
+			"challenges": chs,
+		})
+	}
+
+	writeOrder := func(rw http.ResponseWriter, code int) {
+		o := map[string]interface{}{
+			"status":         orderStatus,
+			"identifiers":    []interface{}{map[string]interface{}{"type": "dns", "value": "a.example.com"}},
+			"authorizations": []string{ts.URL + "/authz/1", ts.URL + "/authz/2"},
+			"finalize":       ts.URL + "/order/1/finalize",
+		}
+		if orderStatus == "valid" {
+			o["certificate"] = ts.URL + "/cert/1"
+		}
+
+		rw.Header().Set("Location", ts.URL+"/order/1")
+		rw.Header().Set("Retry-After", "0")
+		ts.writeJSON(rw, code, o)
+	}
+
+	ts.Handle("/new-order", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		writeOrder(rw, 201)
+	})
+	ts.Handle("/authz/1", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		writeAuthz(rw)
+
+		// Validation completes after the first poll.
+		if chStatus == "processing" {
+			if validationErr != nil {
+				chStatus, azStatus = "invalid", "invalid"
+			} else {
+				chStatus, azStatus, orderStatus = "valid", "valid", "ready"
+			}
+		}
+	})
+	ts.Handle("/authz/2", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		ts.writeJSON(rw, 200, map[string]interface{}{
+			"identifier": map[string]interface{}{"type": "dns", "value": "b.example.com"},
+			"status":     "valid",
+			"challenges": []interface{}{map[string]interface{}{"type": "dns-01", "url": ts.URL + "/chall/4", "status": "valid", "token": "dns-b"}},
+		})
+	})
+	ts.Handle("/chall/", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		var tc *testChallenge
+		for i := range testChallenges {
+			if testChallenges[i].Path == req.URL.Path {
+				tc = &testChallenges[i]
+			}
+		}
+		if tc == nil || chPath != "" || string(payload) != "{}" {
+			ts.t.Errorf("unexpected challenge response: %v %s", req.URL, payload)
+			ts.writeProblem(rw, 400, &Problem{Type: string(ProblemMalformed)})
+			return
+		}
+
+		chPath, chStatus = tc.Path, "processing"
+		validationErr = validate(tc.Type, tc.Token)
+		ts.writeJSON(rw, 200, map[string]interface{}{"type": tc.Type, "url": ts.URL + tc.Path, "status": chStatus, "token": tc.Token})
+	})
+	ts.Handle("/order/1", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		writeOrder(rw, 200)
+		if orderStatus == "processing" {
+			orderStatus = "valid"
+		}
+	})
+	ts.Handle("/order/1/finalize", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if orderStatus != "ready" || !strings.Contains(string(payload), `"csr":"AQID"`) {
+			ts.t.Errorf("unexpected finalization: %s %s", orderStatus, payload)
+		}
+
+		orderStatus = "processing"
+		writeOrder(rw, 200)
+	})
+	ts.Handle("/cert/1", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		rw.Header().Set("Content-Type", "application/pem-certificate-chain")
+		acmeutils.SaveCertificates(rw, crt.Raw)
+	})
+}
+
+func TestObtain(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	handleTestOrder(ts, func(chType, token string) error { return nil })
+
+	httpSolver, dnsSolver := newTestSolver("http-01"), newTestSolver("dns-01")
+	idents := []Identifier{{Type: IdentifierTypeDNS, Value: "a.example.com"}, {Type: IdentifierTypeDNS, Value: "b.example.com"}}
+
+	rc := ts.Client()
+	acct := &Account{URL: ts.URL + "/acct/1", PrivateKey: newTestKey(t)}
+	cert, err := rc.Obtain(context.TODO(), acct, idents, []byte{1, 2, 3}, []ChallengeSolver{dnsSolver, httpSolver})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if cert.URL != ts.URL+"/cert/1" || len(cert.CertificateChain) != 1 {
+		t.Fatalf("unexpected certificate: %#v", cert)
+	}
+	if !dnsSolver.presented["dns"] || !dnsSolver.cleanedUp["dns"] || len(httpSolver.presented) != 0 {
+		t.Fatalf("wrong challenges solved: %v %v", dnsSolver.presented, httpSolver.presented)
+	}
+}
+
+func TestObtainFailure(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	handleTestOrder(ts, func(chType, token string) error { return errors.New("no TXT record") })
+
+	dnsSolver := newTestSolver("dns-01")
+	idents := []Identifier{{Type: IdentifierTypeDNS, Value: "a.example.com"}, {Type: IdentifierTypeDNS, Value: "b.example.com"}}
+
+	rc := ts.Client()
+	acct := &Account{URL: ts.URL + "/acct/1", PrivateKey: newTestKey(t)}
+	_, err := rc.Obtain(context.TODO(), acct, idents, []byte{1, 2, 3}, []ChallengeSolver{newTestSolver("tkauth-01")})
+	if err == nil {
+		t.Fatalf("order without usable challenges did not fail")
+	}
+
+	_, err = rc.Obtain(context.TODO(), acct, idents, []byte{1, 2, 3}, []ChallengeSolver{dnsSolver})
+	ve, ok := err.(*ValidationError)
+	if !ok || ve.Problem == nil || ve.Problem.Detail != "no TXT record" || ve.Challenge.Type != "dns-01" {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	if !dnsSolver.cleanedUp["dns"] {
+		t.Fatalf("challenge not cleaned up after failure")
+	}
+}
+
+func TestObtainTLSALPN01(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	r := &acmeutils.TLSALPNResponder{}
+	acct := &Account{URL: ts.URL + "/acct/1", PrivateKey: newTestKey(t)}
+	handleTestOrder(ts, func(chType, token string) error {
+		if chType != "tls-alpn-01" {
+			return fmt.Errorf("unexpected challenge type: %q", chType)
+		}
+
+		// Perform the validation handshake.
+		c, s := net.Pipe()
+		defer c.Close()
+		go func() {
+			defer s.Close()
+			tls.Server(s, r.TLSConfig()).Handshake()
+		}()
+
+		cc := tls.Client(c, &tls.Config{
+			ServerName:         "a.example.com",
+			NextProtos:         []string{acmeutils.ACMETLS1Protocol},
+			InsecureSkipVerify: true,
+		})
+		err := cc.Handshake()
+		if err != nil {
+			return err
+		}
+
+		ka, err := acmeutils.KeyAuthorization(acct.PrivateKey, token)
+		if err != nil {
+			return err
+		}
+
+		expected := sha256.Sum256([]byte(ka))
+		for _, ext := range cc.ConnectionState().PeerCertificates[0].Extensions {
+			var digest []byte
+			if ext.Id.Equal(oidACMEIdentifier) {
+				_, err = asn1.Unmarshal(ext.Value, &digest)
+				if err == nil && bytes.Equal(digest, expected[:]) {
+					return nil
+				}
+			}
+		}
+
+		return errors.New("incorrect key authorization")
+	})
+
+	idents := []Identifier{{Type: IdentifierTypeDNS, Value: "a.example.com"}, {Type: IdentifierTypeDNS, Value: "b.example.com"}}
+	_, err := ts.Client().Obtain(context.TODO(), acct, idents, []byte{1, 2, 3}, []ChallengeSolver{&TLSALPNSolver{Responder: r}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// The challenge certificate has been removed.
+	_, err = r.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com", SupportedProtos: []string{acmeutils.ACMETLS1Protocol}})
+	if err == nil {
+		t.Fatalf("challenge not cleaned up")
+	}
+}
+
+var oidACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
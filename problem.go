@@ -0,0 +1,138 @@
+package acmeapi
+
+// Identifies a type of problem. The ACME problem types defined by RFC 8555
+// are provided as constants.
+//
+// A ProblemType can be used as the target of errors.Is to check whether an
+// error returned by this package was caused by a problem of that type. For
+// example:
+//
+//	if errors.Is(err, acmeapi.ProblemRateLimited) { ... }
+type ProblemType string
+
+// Allows ProblemType values to be used as sentinel errors.
+func (t ProblemType) Error() string {
+	return string(t)
+}
+
+// ACME problem types defined by RFC 8555.
+const (
+	// The request specified an account that does not exist.
+	ProblemAccountDoesNotExist ProblemType = "urn:ietf:params:acme:error:accountDoesNotExist"
+	// The request specified a certificate to be revoked that has already been
+	// revoked.
+	ProblemAlreadyRevoked ProblemType = "urn:ietf:params:acme:error:alreadyRevoked"
+	// The CSR is unacceptable (e.g., due to a short key).
+	ProblemBadCSR ProblemType = "urn:ietf:params:acme:error:badCSR"
+	// The client sent an unacceptable anti-replay nonce.
+	ProblemBadNonce ProblemType = "urn:ietf:params:acme:error:badNonce"
+	// The JWS was signed by a public key the server does not support.
+	ProblemBadPublicKey ProblemType = "urn:ietf:params:acme:error:badPublicKey"
+	// The revocation reason provided is not allowed by the server.
+	ProblemBadRevocationReason ProblemType = "urn:ietf:params:acme:error:badRevocationReason"
+	// The JWS was signed with an algorithm the server does not support.
+	ProblemBadSignatureAlgorithm ProblemType = "urn:ietf:params:acme:error:badSignatureAlgorithm"
+	// Certification Authority Authorization (CAA) records forbid the CA from
+	// issuing a certificate.
+	ProblemCAA ProblemType = "urn:ietf:params:acme:error:caa"
+	// Specific error conditions are indicated in the subproblems array.
+	ProblemCompound ProblemType = "urn:ietf:params:acme:error:compound"
+	// The server could not connect to validation target.
+	ProblemConnection ProblemType = "urn:ietf:params:acme:error:connection"
+	// There was a problem with a DNS query during identifier validation.
+	ProblemDNS ProblemType = "urn:ietf:params:acme:error:dns"
+	// The request must include a value for the "externalAccountBinding" field.
+	ProblemExternalAccountRequired ProblemType = "urn:ietf:params:acme:error:externalAccountRequired"
+	// Response received didn't match the challenge's requirements.
+	ProblemIncorrectResponse ProblemType = "urn:ietf:params:acme:error:incorrectResponse"
+	// A contact URL for an account was invalid.
+	ProblemInvalidContact ProblemType = "urn:ietf:params:acme:error:invalidContact"
+	// The request message was malformed.
+	ProblemMalformed ProblemType = "urn:ietf:params:acme:error:malformed"
+	// The request attempted to finalize an order that is not ready to be
+	// finalized.
+	ProblemOrderNotReady ProblemType = "urn:ietf:params:acme:error:orderNotReady"
+	// The request exceeds a rate limit.
+	ProblemRateLimited ProblemType = "urn:ietf:params:acme:error:rateLimited"
+	// The server will not issue certificates for the identifier.
+	ProblemRejectedIdentifier ProblemType = "urn:ietf:params:acme:error:rejectedIdentifier"
+	// The server experienced an internal error.
+	ProblemServerInternal ProblemType = "urn:ietf:params:acme:error:serverInternal"
+	// The server received a TLS error during validation.
+	ProblemTLS ProblemType = "urn:ietf:params:acme:error:tls"
+	// The client lacks sufficient authorization.
+	ProblemUnauthorized ProblemType = "urn:ietf:params:acme:error:unauthorized"
+	// A contact URL for an account used an unsupported protocol scheme.
+	ProblemUnsupportedContact ProblemType = "urn:ietf:params:acme:error:unsupportedContact"
+	// An identifier is of an unsupported type.
+	ProblemUnsupportedIdentifier ProblemType = "urn:ietf:params:acme:error:unsupportedIdentifier"
+	// Visit the "instance" URL and take actions specified there.
+	ProblemUserActionRequired ProblemType = "urn:ietf:params:acme:error:userActionRequired"
+)
+
+// Supports errors.Is. Returns true iff target is a ProblemType or *Problem
+// with the same type as this problem. Subproblems are not considered; see
+// HasType.
+func (p *Problem) Is(target error) bool {
+	switch t := target.(type) {
+	case ProblemType:
+		return p.Type == string(t)
+	case *Problem:
+		return t != nil && p.Type == t.Type
+	default:
+		return false
+	}
+}
+
+// Returns true iff this problem or any of its subproblems has the given type.
+func (p *Problem) HasType(t ProblemType) bool {
+	if p.Type == string(t) {
+		return true
+	}
+
+	for _, sp := range p.Subproblem {
+		if sp != nil && sp.HasType(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the subproblems of this problem which relate to the given
+// identifier. If this problem itself relates to the identifier, it is
+// included first. Identifiers are compared exactly, so the identifier should
+// be normalized as it is in orders.
+func (p *Problem) ForIdentifier(id Identifier) []*Problem {
+	var ps []*Problem
+	p.walk(func(sp *Problem) {
+		if sp.Identifier != nil && *sp.Identifier == id {
+			ps = append(ps, sp)
+		}
+	})
+
+	return ps
+}
+
+// Returns the problems relating to specific identifiers, grouped by
+// identifier. This problem and all of its subproblems are considered;
+// problems which do not specify an identifier are omitted.
+func (p *Problem) ByIdentifier() map[Identifier][]*Problem {
+	m := map[Identifier][]*Problem{}
+	p.walk(func(sp *Problem) {
+		if sp.Identifier != nil {
+			m[*sp.Identifier] = append(m[*sp.Identifier], sp)
+		}
+	})
+
+	return m
+}
+
+func (p *Problem) walk(f func(sp *Problem)) {
+	f(p)
+	for _, sp := range p.Subproblem {
+		if sp != nil {
+			sp.walk(f)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package acmeapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestProblemIs(t *testing.T) {
+	p := &Problem{Type: string(ProblemRateLimited)}
+	he := &HTTPError{Res: &http.Response{Status: "429 Too Many Requests", StatusCode: 429}, Problem: p}
+	err := fmt.Errorf("new order failed: %w", he)
+
+	if !errors.Is(err, ProblemRateLimited) || errors.Is(err, ProblemBadNonce) {
+		t.Fatal()
+	}
+	if !errors.Is(err, &Problem{Type: string(ProblemRateLimited)}) {
+		t.Fatal()
+	}
+
+	var p2 *Problem
+	if !errors.As(err, &p2) || p2 != p {
+		t.Fatal()
+	}
+
+	if errors.Is(&HTTPError{Res: he.Res}, ProblemRateLimited) {
+		t.Fatal()
+	}
+
+	ve := &ValidationError{Problem: &Problem{Type: string(ProblemCAA)}}
+	if !errors.Is(ve, ProblemCAA) {
+		t.Fatal()
+	}
+}
+
+func TestProblemSubproblems(t *testing.T) {
+	a := Identifier{Type: IdentifierTypeDNS, Value: "a.example.com"}
+	b := Identifier{Type: IdentifierTypeDNS, Value: "b.example.com"}
+	pa1 := &Problem{Type: string(ProblemCAA), Identifier: &a}
+	pa2 := &Problem{Type: string(ProblemDNS), Identifier: &a}
+	pb := &Problem{Type: string(ProblemRejectedIdentifier), Identifier: &b}
+	p := &Problem{
+		Type:       string(ProblemCompound),
+		Subproblem: []*Problem{pa1, pb, pa2},
+	}
+
+	if !errors.Is(p, ProblemCompound) || errors.Is(p, ProblemCAA) {
+		t.Fatal()
+	}
+	if !p.HasType(ProblemCAA) || p.HasType(ProblemTLS) {
+		t.Fatal()
+	}
+
+	if ps := p.ForIdentifier(a); !reflect.DeepEqual(ps, []*Problem{pa1, pa2}) {
+		t.Fatalf("unexpected problems: %v", ps)
+	}
+	if ps := p.ForIdentifier(Identifier{Type: IdentifierTypeDNS, Value: "c.example.com"}); len(ps) != 0 {
+		t.Fatalf("unexpected problems: %v", ps)
+	}
+
+	m := p.ByIdentifier()
+	if len(m) != 2 || len(m[a]) != 2 || m[b][0] != pb {
+		t.Fatalf("unexpected problems: %v", m)
+	}
+}
@@ -0,0 +1,356 @@
+package acmeapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gopkg.in/hlandau/acmeapi.v2/acmeendpoints"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client-side rate limiter which prevents a RealmClient from making requests
+// which would exceed the rate limits of the ACME server. Set
+// RealmClientConfig.RateLimiter to use it.
+//
+// The following limits are enforced:
+//
+//   - new orders per account: NewOrder waits until an order can be created;
+//   - new accounts: RegisterAccount waits until an account can be created;
+//   - failed validations per identifier per account: NewOrder waits until
+//     orders can be created for all of the order's identifiers. A failed
+//     validation is recorded when an authorization, or one of its
+//     challenges, is loaded in the invalid state. A failed challenge can
+//     only be attributed to an identifier if its authorization was
+//     previously loaded using the same RateLimiter.
+//
+// If the server nevertheless responds with a "rateLimited" problem which
+// specifies a Retry-After time, further requests of the same kind are held
+// until that time.
+//
+// A RateLimiter may be shared between several RealmClients for the same
+// realm. It is concurrency-safe. The zero value enforces no limits other than
+// those signalled by the server using "rateLimited" problems.
+type RateLimiter struct {
+	// If true, methods return a *RateLimitError immediately rather than
+	// waiting when a limit has been reached.
+	FailFast bool
+
+	limits acmeendpoints.RateLimits
+
+	mutex   sync.Mutex
+	events  map[string][]time.Time
+	blocked map[string]time.Time
+
+	// Authorizations whose failure would count against a limit, by the URLs
+	// of the authorization and of its challenges.
+	validations map[string]*trackedValidation
+}
+
+// An authorization tracked so that its failure is counted only once, however
+// many times it or its challenges are loaded.
+type trackedValidation struct {
+	key     string   // Limit key for the authorization's identifier.
+	urls    []string // Authorization and challenge URLs.
+	failed  bool
+	expires time.Time // Time after which the entry is discarded.
+}
+
+// Creates a new rate limiter enforcing the given limits. Typically the limits
+// are taken from the RateLimits field of an acmeendpoints.Endpoint.
+func NewRateLimiter(limits acmeendpoints.RateLimits) *RateLimiter {
+	return &RateLimiter{
+		limits: limits,
+	}
+}
+
+// Allocates the internal maps if necessary, so that the zero value is usable.
+// Must be called with the mutex held.
+func (rl *RateLimiter) init() {
+	if rl.events == nil {
+		rl.events = map[string][]time.Time{}
+	}
+	if rl.blocked == nil {
+		rl.blocked = map[string]time.Time{}
+	}
+	if rl.validations == nil {
+		rl.validations = map[string]*trackedValidation{}
+	}
+}
+
+// Error returned when a request is not made because doing so would exceed a
+// rate limit, and either RateLimiter.FailFast is set or the limit will not
+// reset before the deadline of the request context.
+//
+// errors.Is reports a RateLimitError as matching ProblemRateLimited.
+type RateLimitError struct {
+	// Describes the limit which was reached.
+	Limit string
+
+	// The earliest time at which the request could be made.
+	RetryAt time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit reached (%s), retry at %v", e.Limit, e.RetryAt)
+}
+
+// Supports errors.Is.
+func (e *RateLimitError) Is(target error) bool {
+	t, ok := target.(ProblemType)
+	return ok && t == ProblemRateLimited
+}
+
+func newOrderLimitKey(acct *Account) string {
+	return "new orders for account " + acct.URL
+}
+
+const newAccountLimitKey = "new accounts"
+
+func failedValidationLimitKey(acct *Account, id Identifier) string {
+	return fmt.Sprintf("failed validations for %s %q by account %s", id.Type, strings.ToLower(id.Value), acct.URL)
+}
+
+// Waits until a new order for the given identifiers may be created, and
+// provisionally records its creation. The returned time must be passed to
+// done once the request has been made.
+func (rl *RateLimiter) waitNewOrder(ctx context.Context, acct *Account, identifiers []Identifier) (time.Time, error) {
+	if rl == nil {
+		return time.Time{}, nil
+	}
+
+	for _, id := range identifiers {
+		_, err := rl.take(ctx, failedValidationLimitKey(acct, id), rl.limits.FailedValidationsPerIdentifier, false)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	return rl.take(ctx, newOrderLimitKey(acct), rl.limits.NewOrdersPerAccount, true)
+}
+
+// Waits until a new account may be created, and provisionally records its
+// creation. The returned time must be passed to done once the request has
+// been made.
+func (rl *RateLimiter) waitNewAccount(ctx context.Context) (time.Time, error) {
+	if rl == nil {
+		return time.Time{}, nil
+	}
+
+	return rl.take(ctx, newAccountLimitKey, rl.limits.NewAccountsPerIP, true)
+}
+
+// Called whenever an authorization is loaded. Records a failed validation for
+// its identifier if it is invalid, unless its failure has already been
+// recorded.
+func (rl *RateLimiter) noteAuthorization(acct *Account, az *Authorization) {
+	if rl == nil || rl.limits.FailedValidationsPerIdentifier.Count == 0 || az.URL == "" {
+		return
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.init()
+	now := defaultClock.Now()
+	rl.pruneValidations(now)
+
+	v := rl.validations[az.URL]
+	if v == nil {
+		v = &trackedValidation{
+			key: failedValidationLimitKey(acct, az.Identifier),
+		}
+		rl.trackValidationURL(v, az.URL)
+	}
+	for i := range az.Challenges {
+		rl.trackValidationURL(v, az.Challenges[i].URL)
+	}
+
+	// Remember the authorization at least as long as a failure counts against
+	// the limit, so that reloading it does not count the failure again.
+	v.expires = now.Add(rl.limits.FailedValidationsPerIdentifier.Period)
+	if az.Expires.After(v.expires) {
+		v.expires = az.Expires
+	}
+
+	if az.Status == AuthorizationInvalid {
+		rl.failValidation(v, now)
+	}
+}
+
+// Called whenever a challenge is loaded. Records a failed validation if it is
+// invalid and its authorization has been loaded, unless the failure has
+// already been recorded.
+func (rl *RateLimiter) noteChallenge(ch *Challenge) {
+	if rl == nil || ch.Status != ChallengeInvalid {
+		return
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.init()
+	now := defaultClock.Now()
+	rl.pruneValidations(now)
+
+	if v, ok := rl.validations[ch.URL]; ok {
+		rl.failValidation(v, now)
+	}
+}
+
+// Must be called with the mutex held.
+func (rl *RateLimiter) trackValidationURL(v *trackedValidation, u string) {
+	if u == "" || rl.validations[u] == v {
+		return
+	}
+
+	rl.validations[u] = v
+	v.urls = append(v.urls, u)
+}
+
+// Must be called with the mutex held.
+func (rl *RateLimiter) failValidation(v *trackedValidation, now time.Time) {
+	if v.failed {
+		return
+	}
+
+	v.failed = true
+	rl.events[v.key] = append(rl.events[v.key], now)
+}
+
+// Discards expired tracked validations. Must be called with the mutex held.
+func (rl *RateLimiter) pruneValidations(now time.Time) {
+	for u, v := range rl.validations {
+		if now.After(v.expires) {
+			delete(rl.validations, u)
+		}
+	}
+}
+
+// Waits until an operation counted against the given limit is permitted,
+// then records it if record is true. Returns the time at which the operation
+// was recorded.
+func (rl *RateLimiter) take(ctx context.Context, key string, limit acmeendpoints.RateLimit, record bool) (time.Time, error) {
+	for {
+		rl.mutex.Lock()
+		rl.init()
+		now := defaultClock.Now()
+		t := rl.nextAllowed(key, limit, now)
+		if !t.After(now) {
+			if record {
+				rl.events[key] = append(rl.events[key], now)
+			}
+			rl.mutex.Unlock()
+			return now, nil
+		}
+		rl.mutex.Unlock()
+
+		if rl.FailFast {
+			return time.Time{}, &RateLimitError{Limit: key, RetryAt: t}
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && t.After(deadline) {
+			return time.Time{}, &RateLimitError{Limit: key, RetryAt: t}
+		}
+
+		log.Debugf("waiting until %v due to rate limit (%s)", t, key)
+		err := waitUntil(ctx, t)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+}
+
+// Returns the earliest time at which an operation counted against the given
+// limit is permitted. Must be called with the mutex held.
+func (rl *RateLimiter) nextAllowed(key string, limit acmeendpoints.RateLimit, now time.Time) time.Time {
+	t := now
+	if b, ok := rl.blocked[key]; ok {
+		if b.After(now) {
+			t = b
+		} else {
+			delete(rl.blocked, key)
+		}
+	}
+
+	// Discard events outside the window.
+	events := rl.events[key]
+	i := 0
+	for i < len(events) && !events[i].After(now.Add(-limit.Period)) {
+		i++
+	}
+	events = events[i:]
+	if len(events) == 0 {
+		delete(rl.events, key)
+	} else {
+		rl.events[key] = events
+	}
+
+	if limit.Count > 0 && len(events) >= limit.Count {
+		if et := events[len(events)-limit.Count].Add(limit.Period); et.After(t) {
+			t = et
+		}
+	}
+
+	return t
+}
+
+// Called with the result of a request for an operation provisionally
+// recorded at time t by take. If the server responded with an error, the
+// operation did not happen and the record is removed. For other errors, such
+// as transport errors, the server may still have performed the operation, so
+// the record is kept.
+//
+// If err is a "rateLimited" problem for which the server specified a retry
+// time, further operations counted against the given limit are held until
+// that time.
+func (rl *RateLimiter) done(key string, t time.Time, err error) {
+	if rl == nil || err == nil {
+		return
+	}
+
+	var he *HTTPError
+	if errors.As(err, &he) {
+		rl.mutex.Lock()
+		events := rl.events[key]
+		for i := len(events) - 1; i >= 0; i-- {
+			if events[i].Equal(t) {
+				rl.events[key] = append(events[:i:i], events[i+1:]...)
+				break
+			}
+		}
+		rl.mutex.Unlock()
+	}
+
+	rl.observe(key, err)
+}
+
+// If err is a "rateLimited" problem for which the server specified a retry
+// time, holds further operations counted against the given limit until that
+// time.
+func (rl *RateLimiter) observe(key string, err error) {
+	if rl == nil || !errors.Is(err, ProblemRateLimited) {
+		return
+	}
+
+	var t time.Time
+	var rae *RetryAfterError
+	var he *HTTPError
+	if errors.As(err, &rae) {
+		t = rae.RetryAt
+	} else if errors.As(err, &he) {
+		var ok bool
+		t, ok = parseRetryAfter(he.Res.Header)
+		if !ok {
+			return
+		}
+	} else {
+		return
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.init()
+	if t.After(rl.blocked[key]) {
+		rl.blocked[key] = t
+	}
+}
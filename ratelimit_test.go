@@ -0,0 +1,310 @@
+package acmeapi
+
+import (
+	"context"
+	"errors"
+	"gopkg.in/hlandau/acmeapi.v2/acmeendpoints"
+	"gopkg.in/square/go-jose.v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	var rateLimited, malformed bool
+	orders := 0
+	ts.Handle("/new-order", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		orders++
+		if malformed {
+			ts.writeProblem(rw, 400, &Problem{Type: string(ProblemMalformed)})
+			return
+		}
+		if rateLimited {
+			rw.Header().Set("Retry-After", "3600")
+			ts.writeProblem(rw, 429, &Problem{Type: string(ProblemRateLimited)})
+			return
+		}
+
+		rw.Header().Set("Location", ts.URL+"/order/1")
+		ts.writeJSON(rw, 201, map[string]interface{}{"status": "pending"})
+	})
+	ts.Handle("/authz/1", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		ts.writeJSON(rw, 200, map[string]interface{}{
+			"identifier": map[string]interface{}{"type": "dns", "value": "b.example.com"},
+			"status":     "invalid",
+			"challenges": []interface{}{map[string]interface{}{"type": "http-01", "url": ts.URL + "/chall/1", "status": "invalid"}},
+		})
+	})
+
+	rl := NewRateLimiter(acmeendpoints.RateLimits{
+		NewOrdersPerAccount:            acmeendpoints.RateLimit{Count: 2, Period: time.Hour},
+		FailedValidationsPerIdentifier: acmeendpoints.RateLimit{Count: 1, Period: time.Hour},
+	})
+	rl.FailFast = true
+
+	rc, err := NewRealmClient(RealmClientConfig{
+		DirectoryURL: ts.URL + "/dir",
+		RateLimiter:  rl,
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	acct := &Account{URL: ts.URL + "/acct/1", PrivateKey: newTestKey(t)}
+	acct2 := &Account{URL: ts.URL + "/acct/2", PrivateKey: acct.PrivateKey}
+	newOrder := func(acct *Account, name string) error {
+		return rc.NewOrder(context.TODO(), acct, &Order{
+			Identifiers: []Identifier{{Type: IdentifierTypeDNS, Value: name}},
+		})
+	}
+
+	// Failed requests do not count towards the limit.
+	malformed = true
+	err = newOrder(acct, "a.example.com")
+	if !errors.Is(err, ProblemMalformed) {
+		t.Fatalf("expected malformed problem, got %v", err)
+	}
+	malformed = false
+	orders = 0
+
+	// Two orders are permitted per account, after which requests fail without
+	// being sent.
+	for i := 0; i < 2; i++ {
+		err = newOrder(acct, "a.example.com")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	err = newOrder(acct, "a.example.com")
+	rle, ok := err.(*RateLimitError)
+	if !ok || !errors.Is(err, ProblemRateLimited) || orders != 2 {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+	if d := rle.RetryAt.Sub(time.Now()); d < 59*time.Minute || d > time.Hour {
+		t.Fatalf("unexpected retry time: %v", rle.RetryAt)
+	}
+
+	// A failed validation prevents further orders for the identifier.
+	err = rc.WaitForAuthorization(context.TODO(), acct2, &Authorization{URL: ts.URL + "/authz/1"})
+	if _, ok := err.(*ValidationError); !ok {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+
+	err = newOrder(acct2, "B.example.com")
+	if _, ok := err.(*RateLimitError); !ok || orders != 2 {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+
+	// Rate limit problems from the server hold further requests.
+	rateLimited = true
+	err = newOrder(acct2, "c.example.com")
+	if !errors.Is(err, ProblemRateLimited) || orders != 3 {
+		t.Fatalf("expected rate limit problem, got %v", err)
+	}
+
+	err = newOrder(acct2, "c.example.com")
+	rle, ok = err.(*RateLimitError)
+	if !ok || orders != 3 || rle.RetryAt.Sub(time.Now()) < 59*time.Minute {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	rl := NewRateLimiter(acmeendpoints.RateLimits{
+		NewAccountsPerIP: acmeendpoints.RateLimit{Count: 2, Period: 200 * time.Millisecond},
+	})
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		_, err := rl.waitNewAccount(context.TODO())
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := rl.waitNewAccount(ctx)
+	if _, ok := err.(*RateLimitError); !ok {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+
+	_, err = rl.waitNewAccount(context.TODO())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("third account was not delayed: %v", d)
+	}
+}
+
+func TestRateLimiterZero(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	orders := 0
+	ts.Handle("/new-order", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		orders++
+		rw.Header().Set("Retry-After", "3600")
+		ts.writeProblem(rw, 429, &Problem{Type: string(ProblemRateLimited)})
+	})
+
+	// The zero value enforces only limits signalled by the server.
+	rc, err := NewRealmClient(RealmClientConfig{
+		DirectoryURL: ts.URL + "/dir",
+		RateLimiter:  &RateLimiter{FailFast: true},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	acct := &Account{URL: ts.URL + "/acct/1", PrivateKey: newTestKey(t)}
+	for i := 0; i < 2; i++ {
+		err = rc.NewOrder(context.TODO(), acct, &Order{
+			Identifiers: []Identifier{{Type: IdentifierTypeDNS, Value: "a.example.com"}},
+		})
+		if !errors.Is(err, ProblemRateLimited) || orders != 1 {
+			t.Fatalf("expected rate limit problem, got %v", err)
+		}
+	}
+
+	rc.cfg.RateLimiter.noteAuthorization(acct, &Authorization{
+		URL:        ts.URL + "/authz/1",
+		Identifier: Identifier{Type: IdentifierTypeDNS, Value: "a.example.com"},
+		Status:     AuthorizationInvalid,
+	})
+	rc.cfg.RateLimiter.noteChallenge(&Challenge{URL: ts.URL + "/chall/1", Status: ChallengeInvalid})
+}
+
+func TestRateLimiterFailedValidations(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	authzStatus := map[string]string{"1": "pending", "2": "invalid"}
+	ts.Handle("/authz/", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		n := strings.TrimPrefix(req.URL.Path, "/authz/")
+		ts.writeJSON(rw, 200, map[string]interface{}{
+			"identifier": map[string]interface{}{"type": "dns", "value": "a.example.com"},
+			"status":     authzStatus[n],
+			"challenges": []interface{}{map[string]interface{}{"type": "http-01", "url": ts.URL + "/chall/" + n, "status": authzStatus[n]}},
+		})
+	})
+	ts.Handle("/chall/1", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		ts.writeJSON(rw, 200, map[string]interface{}{"type": "http-01", "url": ts.URL + "/chall/1", "status": "invalid"})
+	})
+	ts.Handle("/new-order", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		rw.Header().Set("Location", ts.URL+"/order/1")
+		ts.writeJSON(rw, 201, map[string]interface{}{"status": "pending"})
+	})
+
+	rl := NewRateLimiter(acmeendpoints.RateLimits{
+		FailedValidationsPerIdentifier: acmeendpoints.RateLimit{Count: 2, Period: time.Hour},
+	})
+	rl.FailFast = true
+
+	rc, err := NewRealmClient(RealmClientConfig{
+		DirectoryURL: ts.URL + "/dir",
+		RateLimiter:  rl,
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	acct := &Account{URL: ts.URL + "/acct/1", PrivateKey: newTestKey(t)}
+	newOrder := func() error {
+		return rc.NewOrder(context.TODO(), acct, &Order{
+			Identifiers: []Identifier{{Type: IdentifierTypeDNS, Value: "a.example.com"}},
+		})
+	}
+
+	// A challenge loaded in the invalid state counts as a failed validation,
+	// once its authorization is known. Reloading the challenge or the
+	// authorization does not count it again.
+	az := &Authorization{URL: ts.URL + "/authz/1"}
+	err = rc.LoadAuthorization(context.TODO(), acct, az)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = rc.LoadChallenge(context.TODO(), acct, &Challenge{URL: ts.URL + "/chall/1"})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	authzStatus["1"] = "invalid"
+	err = rc.LoadAuthorization(context.TODO(), acct, az)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	err = newOrder()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// An authorization loaded in the invalid state also counts.
+	err = rc.LoadAuthorization(context.TODO(), acct, &Authorization{URL: ts.URL + "/authz/2"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	err = newOrder()
+	if _, ok := err.(*RateLimitError); !ok {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+}
+
+func TestRateLimiterTransportError(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	var orders int32
+	ts.Handle("/new-order", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		atomic.AddInt32(&orders, 1)
+		conn, _, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+
+		conn.Close()
+	})
+
+	rl := NewRateLimiter(acmeendpoints.RateLimits{
+		NewOrdersPerAccount: acmeendpoints.RateLimit{Count: 1, Period: time.Hour},
+	})
+	rl.FailFast = true
+
+	rc, err := NewRealmClient(RealmClientConfig{
+		DirectoryURL: ts.URL + "/dir",
+		RateLimiter:  rl,
+		RetryPolicy:  RetryPolicy{MaxTries: 1},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// The server may have created the order before the connection failed, so
+	// the order still counts towards the limit.
+	acct := &Account{URL: ts.URL + "/acct/1", PrivateKey: newTestKey(t)}
+	for i := 0; i < 2; i++ {
+		err = rc.NewOrder(context.TODO(), acct, &Order{
+			Identifiers: []Identifier{{Type: IdentifierTypeDNS, Value: "a.example.com"}},
+		})
+		if err == nil || atomic.LoadInt32(&orders) != 1 {
+			t.Fatalf("expected error, got %v", err)
+		}
+	}
+
+	if _, ok := err.(*RateLimitError); !ok {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+}
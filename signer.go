@@ -0,0 +1,242 @@
+package acmeapi
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"gopkg.in/square/go-jose.v2"
+	"math/big"
+)
+
+// Adapts a crypto.Signer to the go-jose OpaqueSigner interface. This allows
+// account keys which are not held in process memory, such as keys held in an
+// HSM or a cloud KMS, to be used to sign requests.
+type opaqueSigner struct {
+	signer crypto.Signer
+	alg    jose.SignatureAlgorithm
+}
+
+func newOpaqueSigner(signer crypto.Signer, alg jose.SignatureAlgorithm) (*opaqueSigner, error) {
+	alg, err := checkAlgorithm(signer.Public(), alg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &opaqueSigner{
+		signer: signer,
+		alg:    alg,
+	}, nil
+}
+
+// Implements jose.OpaqueSigner.
+func (s *opaqueSigner) Public() *jose.JSONWebKey {
+	return &jose.JSONWebKey{
+		Key: s.signer.Public(),
+	}
+}
+
+// Implements jose.OpaqueSigner.
+func (s *opaqueSigner) Algs() []jose.SignatureAlgorithm {
+	return []jose.SignatureAlgorithm{s.alg}
+}
+
+// Implements jose.OpaqueSigner.
+func (s *opaqueSigner) SignPayload(payload []byte, alg jose.SignatureAlgorithm) ([]byte, error) {
+	if alg != s.alg {
+		return nil, fmt.Errorf("unsupported signature algorithm: %v", alg)
+	}
+
+	// Ed25519 signs the message itself rather than a digest.
+	if alg == jose.EdDSA {
+		return s.signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+
+	hash, err := hashFromAlgorithm(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts crypto.SignerOpts = hash
+	switch alg {
+	case jose.PS256, jose.PS384, jose.PS512:
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash}
+	}
+
+	h := hash.New()
+	h.Write(payload)
+	sig, err := s.signer.Sign(rand.Reader, h.Sum(nil), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, ok := s.signer.Public().(*ecdsa.PublicKey)
+	if !ok {
+		return sig, nil
+	}
+
+	// crypto.Signer returns ASN.1 DER-encoded ECDSA signatures, but JWS
+	// requires the concatenation of the fixed-length R and S values.
+	var esig struct {
+		R, S *big.Int
+	}
+	_, err = asn1.Unmarshal(sig, &esig)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse ECDSA signature: %v", err)
+	}
+
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	if esig.R.Sign() < 0 || esig.S.Sign() < 0 || esig.R.BitLen() > size*8 || esig.S.BitLen() > size*8 {
+		return nil, fmt.Errorf("invalid ECDSA signature")
+	}
+
+	out := make([]byte, 2*size)
+	esig.R.FillBytes(out[0:size])
+	esig.S.FillBytes(out[size:])
+	return out, nil
+}
+
+func hashFromAlgorithm(alg jose.SignatureAlgorithm) (crypto.Hash, error) {
+	switch alg {
+	case jose.RS256, jose.PS256, jose.ES256:
+		return crypto.SHA256, nil
+	case jose.RS384, jose.PS384, jose.ES384:
+		return crypto.SHA384, nil
+	case jose.RS512, jose.PS512, jose.ES512:
+		return crypto.SHA512, nil
+	default:
+		return 0, fmt.Errorf("unsupported signature algorithm: %v", alg)
+	}
+}
+
+// Returns the JWS signature algorithms which can be used with the given
+// public key, in order of preference. The first is the default algorithm
+// returned by algorithmFromPublicKey.
+func algorithmsFromPublicKey(pub crypto.PublicKey) ([]jose.SignatureAlgorithm, error) {
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		return []jose.SignatureAlgorithm{jose.RS256, jose.PS256, jose.RS384, jose.PS384, jose.RS512, jose.PS512}, nil
+	}
+
+	alg, err := algorithmFromPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	return []jose.SignatureAlgorithm{alg}, nil
+}
+
+// Returns alg if it can be used with the given public key, or the default
+// algorithm for the key if alg is empty.
+func checkAlgorithm(pub crypto.PublicKey, alg jose.SignatureAlgorithm) (jose.SignatureAlgorithm, error) {
+	algs, err := algorithmsFromPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+
+	if alg == "" {
+		return algs[0], nil
+	}
+
+	for _, a := range algs {
+		if a == alg {
+			return alg, nil
+		}
+	}
+
+	return "", fmt.Errorf("signature algorithm %v cannot be used with key of type %T", alg, pub)
+}
+
+// Returns the key to be passed to go-jose for signing with the given private
+// key using the signature algorithm alg, or the default algorithm for the key
+// if alg is empty. RSA, ECDSA and Ed25519 keys held in memory are used
+// directly; any other crypto.Signer is wrapped as an opaque signer.
+func signingKeyFromKey(key crypto.PrivateKey, alg jose.SignatureAlgorithm) (jose.SigningKey, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+		alg, err := checkAlgorithm(key.(crypto.Signer).Public(), alg)
+		if err != nil {
+			return jose.SigningKey{}, err
+		}
+
+		return jose.SigningKey{Algorithm: alg, Key: key}, nil
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return jose.SigningKey{}, fmt.Errorf("unsupported private key type: %T", key)
+	}
+
+	os, err := newOpaqueSigner(signer, alg)
+	if err != nil {
+		return jose.SigningKey{}, err
+	}
+
+	return jose.SigningKey{Algorithm: os.alg, Key: os}, nil
+}
+
+// Returns the signature algorithm to be used when signing requests with the
+// given key, or with the account key if key is nil. This is the key's most
+// preferred algorithm among those which the server has indicated it accepts,
+// or its default algorithm if there is no such algorithm or the server has
+// not rejected any algorithm. Returns an empty string if there is no usable
+// key.
+func (c *RealmClient) signatureAlgorithm(acct *Account, key crypto.PrivateKey) jose.SignatureAlgorithm {
+	if key == nil && acct != nil {
+		key = acct.PrivateKey
+	}
+
+	pub, err := publicKeyFromKey(key)
+	if err != nil {
+		return ""
+	}
+
+	algs, err := algorithmsFromPublicKey(pub)
+	if err != nil {
+		return ""
+	}
+
+	c.algMutex.Lock()
+	defer c.algMutex.Unlock()
+	for _, alg := range algs {
+		for _, a := range c.acceptedAlgs {
+			if alg == a {
+				return alg
+			}
+		}
+	}
+
+	return algs[0]
+}
+
+// If err is a "badSignatureAlgorithm" problem listing the algorithms accepted
+// by the server, records them for future requests to the realm. Returns true
+// iff a request signed using alg should be retried because the key supports
+// a different algorithm which the server accepts.
+func (c *RealmClient) negotiateAlgorithm(err error, acct *Account, key crypto.PrivateKey, alg jose.SignatureAlgorithm) bool {
+	var he *HTTPError
+	if alg == "" || !errors.As(err, &he) || !errors.Is(he, ProblemBadSignatureAlgorithm) || len(he.Problem.Algorithms) == 0 {
+		return false
+	}
+
+	accepted := make([]jose.SignatureAlgorithm, len(he.Problem.Algorithms))
+	for i, a := range he.Problem.Algorithms {
+		accepted[i] = jose.SignatureAlgorithm(a)
+	}
+
+	c.algMutex.Lock()
+	c.acceptedAlgs = accepted
+	c.algMutex.Unlock()
+
+	newAlg := c.signatureAlgorithm(acct, key)
+	for _, a := range accepted {
+		if a == newAlg {
+			return newAlg != alg
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,180 @@
+package acmeapi
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"gopkg.in/hlandau/acmeapi.v2/acmeutils"
+	"gopkg.in/square/go-jose.v2"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// Hides the concrete type of a key, as is the case for keys held in an HSM.
+type testSigner struct {
+	crypto.Signer
+}
+
+func TestOpaqueSigner(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	tests := []struct {
+		Key       crypto.Signer
+		Algorithm string
+	}{
+		{rsaKey, "RS256"},
+		{ecKey, "ES384"},
+		{edKey, "EdDSA"},
+		{testSigner{rsaKey}, "RS256"},
+		{testSigner{ecKey}, "ES384"},
+		{testSigner{edKey}, "EdDSA"},
+	}
+
+	for _, tst := range tests {
+		s, err := signJWSBytes(tst.Key, "", []byte("payload"), &jose.SignerOptions{EmbedJWK: true})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		jws, err := jose.ParseSigned(s)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		h := jws.Signatures[0].Protected
+		if h.Algorithm != tst.Algorithm || h.JSONWebKey == nil {
+			t.Fatalf("unexpected header: %#v", h)
+		}
+
+		payload, err := jws.Verify(tst.Key.Public())
+		if err != nil || string(payload) != "payload" {
+			t.Fatalf("signature verification failed: %v", err)
+		}
+
+		if !reflect.DeepEqual(h.JSONWebKey.Key, tst.Key.Public()) {
+			t.Fatalf("embedded key mismatch: %#v", h.JSONWebKey.Key)
+		}
+
+		tp1, err := acmeutils.Base64Thumbprint(tst.Key)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		tp2, err := acmeutils.Base64Thumbprint(tst.Key.Public())
+		if err != nil || tp1 != tp2 {
+			t.Fatalf("thumbprint mismatch: %v", err)
+		}
+	}
+}
+
+func TestRevokeWithSigner(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	key := newTestKey(t)
+	ts.Handle("/revoke-cert", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		if _, err := jws.Verify(&key.PublicKey); err != nil {
+			t.Errorf("revocation request not signed by key: %v", err)
+		}
+		if jwk := jws.Signatures[0].Protected.JSONWebKey; jwk == nil || !jwk.IsPublic() {
+			t.Errorf("revocation request does not embed public key")
+		}
+
+		rw.WriteHeader(200)
+	})
+
+	rc := ts.Client()
+	err := rc.Revoke(context.TODO(), nil, []byte{1, 2, 3}, testSigner{key}, 0)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestSignatureAlgorithmNegotiation(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var algs []string
+	ts.Handle("/res/", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		alg := jws.Signatures[0].Protected.Algorithm
+		algs = append(algs, alg)
+		if alg != "PS256" && alg != "ES256" {
+			ts.writeProblem(rw, 400, &Problem{
+				Type:       string(ProblemBadSignatureAlgorithm),
+				Algorithms: []string{"PS256", "ES256"},
+			})
+			return
+		}
+
+		if _, err := jws.Verify(&key.PublicKey); err != nil {
+			t.Errorf("signature verification failed: %v", err)
+		}
+
+		ts.writeJSON(rw, 200, map[string]interface{}{})
+	})
+
+	tests := []struct {
+		Key crypto.Signer
+		OK  bool
+	}{
+		{key, true},
+		{testSigner{key}, true},
+		{ecKey, false},
+	}
+
+	for i, tst := range tests {
+		rc := ts.Client()
+		acct := &Account{URL: ts.URL + "/acct/1", PrivateKey: tst.Key}
+
+		// The first request is re-signed using an accepted algorithm.
+		algs = nil
+		_, err := rc.doReq(context.TODO(), "POST", ts.URL+"/res/1", acct, nil, "", nil)
+		if (err == nil) != tst.OK {
+			t.Fatalf("test %d: unexpected result: %v", i, err)
+		}
+		if !tst.OK {
+			if !errors.Is(err, ProblemBadSignatureAlgorithm) || len(algs) != 1 {
+				t.Fatalf("test %d: unexpected error or requests: %v %v", i, err, algs)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(algs, []string{"RS256", "PS256"}) {
+			t.Fatalf("test %d: unexpected algorithms: %v", i, algs)
+		}
+
+		// The negotiated algorithm is used for subsequent requests.
+		algs = nil
+		_, err = rc.doReq(context.TODO(), "POST", ts.URL+"/res/1", acct, nil, "", nil)
+		if err != nil || !reflect.DeepEqual(algs, []string{"PS256"}) {
+			t.Fatalf("test %d: unexpected result: %v %v", i, err, algs)
+		}
+	}
+}
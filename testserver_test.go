@@ -0,0 +1,112 @@
+package acmeapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/square/go-jose.v2"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// Minimal in-process ACME server used to test RealmClient methods without
+// needing Pebble. Each test registers handlers for the paths it exercises;
+// the directory and nonce endpoints are provided automatically.
+type testServer struct {
+	*httptest.Server
+	t   *testing.T
+	mux *http.ServeMux
+
+	// Directory served at /dir. Tests may modify this before the first
+	// request is made.
+	Directory map[string]interface{}
+
+	nonceCounter int64
+}
+
+// A handler for a test endpoint. The parsed JWS and its (unverified) payload
+// are passed if the request had a body.
+type testHandlerFunc func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte)
+
+func newTestServer(t *testing.T) *testServer {
+	TestingAllowHTTP = true
+
+	ts := &testServer{
+		t:   t,
+		mux: http.NewServeMux(),
+	}
+	ts.Server = httptest.NewServer(ts.mux)
+	ts.Directory = map[string]interface{}{
+		"newNonce":   ts.URL + "/new-nonce",
+		"newAccount": ts.URL + "/new-account",
+		"newOrder":   ts.URL + "/new-order",
+		"revokeCert": ts.URL + "/revoke-cert",
+		"keyChange":  ts.URL + "/key-change",
+	}
+
+	ts.mux.HandleFunc("/dir", func(rw http.ResponseWriter, req *http.Request) {
+		ts.writeJSON(rw, 200, ts.Directory)
+	})
+	ts.mux.HandleFunc("/new-nonce", func(rw http.ResponseWriter, req *http.Request) {
+		ts.addNonce(rw)
+		rw.WriteHeader(200)
+	})
+
+	return ts
+}
+
+func (ts *testServer) Client() *RealmClient {
+	rc, err := NewRealmClient(RealmClientConfig{
+		DirectoryURL: ts.URL + "/dir",
+	})
+	if err != nil {
+		ts.t.Fatalf("cannot create realm client: %v", err)
+	}
+
+	return rc
+}
+
+func (ts *testServer) Handle(path string, f testHandlerFunc) {
+	ts.mux.HandleFunc(path, func(rw http.ResponseWriter, req *http.Request) {
+		var jws *jose.JSONWebSignature
+		var payload []byte
+
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			ts.t.Errorf("cannot read request body: %v", err)
+			return
+		}
+
+		if len(b) > 0 {
+			jws, err = jose.ParseSigned(string(b))
+			if err != nil {
+				ts.t.Errorf("cannot parse JWS: %v", err)
+				return
+			}
+
+			payload = jws.UnsafePayloadWithoutVerification()
+		}
+
+		ts.addNonce(rw)
+		f(rw, req, jws, payload)
+	})
+}
+
+func (ts *testServer) addNonce(rw http.ResponseWriter) {
+	n := atomic.AddInt64(&ts.nonceCounter, 1)
+	rw.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", n))
+}
+
+func (ts *testServer) writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(v)
+}
+
+func (ts *testServer) writeProblem(rw http.ResponseWriter, code int, p *Problem) {
+	rw.Header().Set("Content-Type", "application/problem+json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(p)
+}
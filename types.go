@@ -4,6 +4,7 @@ import (
 	"crypto"
 	"encoding/json"
 	"fmt"
+	"gopkg.in/hlandau/acmeapi.v2/acmeutils"
 	"gopkg.in/square/go-jose.v2"
 	"time"
 )
@@ -30,6 +31,10 @@ type Problem struct {
 
 	// ACME-specific. Optional. Identifier relating to this problem.
 	Identifier *Identifier `json:"identifier,omitempty"`
+
+	// ACME-specific. Optional. For "badSignatureAlgorithm" problems, the JWS
+	// signature algorithms which the server accepts.
+	Algorithms []string `json:"algorithms,omitempty"`
 }
 
 func (p *Problem) Error() string {
@@ -53,12 +58,33 @@ func (id *Identifier) String() string {
 	return fmt.Sprintf("Identifier(%q, %q)", id.Type, id.Value)
 }
 
-// A type of Identifier. Currently, the only supported value is "dns".
+// Creates an identifier for the given hostname or IP address. An IP address
+// yields an IdentifierTypeIP identifier, and anything else yields an
+// IdentifierTypeDNS identifier. The value is normalized; an error is returned
+// if it is not a valid hostname or IP address.
+func NewIdentifier(value string) (Identifier, error) {
+	if acmeutils.ValidateIP(value) {
+		ip, err := acmeutils.NormalizeIP(value)
+		return Identifier{Type: IdentifierTypeIP, Value: ip}, err
+	}
+
+	hostname, err := acmeutils.NormalizeHostname(value)
+	if err != nil {
+		return Identifier{}, err
+	}
+
+	return Identifier{Type: IdentifierTypeDNS, Value: hostname}, nil
+}
+
+// A type of Identifier. Currently, the supported values are "dns" and "ip".
 type IdentifierType string
 
 const (
 	// Indicates that the identifier value is a DNS name.
 	IdentifierTypeDNS IdentifierType = "dns"
+	// Indicates that the identifier value is an IPv4 or IPv6 address (RFC
+	// 8738). The value must be in canonical form; see acmeutils.NormalizeIP.
+	IdentifierTypeIP IdentifierType = "ip"
 )
 
 // ---------------------------------------------------------------------------------------------------------
@@ -71,6 +97,9 @@ type Account struct {
 	// Private key used to authorize requests. This is never sent to any server,
 	// but is used to sign requests when passed as an argument to RealmClient
 	// methods.
+	//
+	// Any crypto.Signer with an RSA, ECDSA or Ed25519 public key may be used,
+	// so the key may be held in an HSM or KMS rather than in memory.
 	PrivateKey crypto.PrivateKey `json:"-"`
 
 	// Account public key.
@@ -108,6 +137,74 @@ type Account struct {
 	//
 	// Always sent by server, if enumeration is supported. Read only.
 	OrdersURL string `json:"orders,omitempty"`
+
+	// Credentials used to bind the account to an external account when
+	// registering it. Some realms require this; see
+	// RealmMeta.ExternalAccountRequired. This is never sent to any server as
+	// is, and is only used by RegisterAccount.
+	ExternalAccountBinding *ExternalAccountBinding `json:"-"`
+}
+
+// External account binding credentials. These are provided to the
+// accountholder by the CA via out-of-band means.
+type ExternalAccountBinding struct {
+	// The key identifier provided by the CA.
+	KeyID string
+
+	// The MAC key provided by the CA. This is the raw key, not its base64url
+	// encoding.
+	HMACKey []byte
+
+	// The MAC algorithm to use. Must be HS256, HS384 or HS512. Defaults to HS256
+	// if not specified.
+	Algorithm jose.SignatureAlgorithm
+}
+
+// Creates the external account binding JWS, binding the account key to the
+// external account. url must be the newAccount URL.
+func (eab *ExternalAccountBinding) sign(accountKey crypto.PrivateKey, url string) (json.RawMessage, error) {
+	alg := eab.Algorithm
+	switch alg {
+	case "":
+		alg = jose.HS256
+	case jose.HS256, jose.HS384, jose.HS512:
+	default:
+		return nil, fmt.Errorf("unsupported external account binding algorithm: %q", alg)
+	}
+
+	if eab.KeyID == "" || len(eab.HMACKey) == 0 {
+		return nil, fmt.Errorf("external account binding key ID and MAC key must be specified")
+	}
+
+	pub, err := publicKeyFromKey(accountKey)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(&jose.JSONWebKey{Key: pub})
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: alg,
+		Key:       eab.HMACKey,
+	}, &jose.SignerOptions{
+		ExtraHeaders: map[jose.HeaderKey]interface{}{
+			"kid": eab.KeyID,
+			"url": url,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := signer.Sign(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.RawMessage(sig.FullSerialize()), nil
 }
 
 // Specifies a current account status.
@@ -194,6 +291,22 @@ type Order struct {
 	NotBefore time.Time `json:"notBefore,omitempty"` // RFC 3339
 	NotAfter  time.Time `json:"notAfter,omitempty"`  // RFC 3339
 
+	// Optionally sent by client at order creation time to indicate that the
+	// order is intended to replace a previously issued certificate. This is
+	// the ARI certificate identifier of that certificate; see RenewalCertID.
+	//
+	// Sent by server if it was sent by the client. Immutable after resource
+	// creation.
+	Replaces string `json:"replaces,omitempty"`
+
+	// Optionally sent by client at order creation time to select the
+	// certificate profile to be used for issuance. Must be one of the profiles
+	// offered by the realm; see RealmMeta.Profiles.
+	//
+	// Sent by server if a profile was selected. Immutable after resource
+	// creation.
+	Profile string `json:"profile,omitempty"`
+
 	// An error which occurred during the processing of the order, if any.
 	Error *Problem `json:"error,omitempty"` // RFC7807
 
@@ -469,4 +582,11 @@ type Certificate struct {
 	// Does not generally include the root certificate. If you need it (e.g.
 	// because you are using DANE) you must append it yourself.
 	CertificateChain [][]byte `json:"-"`
+
+	// URLs of alternate certificate chains offered by the server for the same
+	// end-entity certificate, if any. Each can be loaded as a Certificate. See
+	// also LoadCertificateChains.
+	//
+	// Sent by server. Read only.
+	AlternateURLs []string `json:"-"`
 }
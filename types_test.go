@@ -19,3 +19,25 @@ func TestStatus(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestNewIdentifier(t *testing.T) {
+	type entry struct {
+		Input string
+		Type  IdentifierType
+		Value string
+	}
+
+	var entries = []entry{
+		{"Example.com.", IdentifierTypeDNS, "example.com"},
+		{"192.0.2.1", IdentifierTypeIP, "192.0.2.1"},
+		{"2001:DB8::1", IdentifierTypeIP, "2001:db8::1"},
+		{"ex ample.com", "", ""},
+	}
+
+	for _, e := range entries {
+		id, err := NewIdentifier(e.Input)
+		if (err == nil) != (e.Type != "") || id.Type != e.Type || id.Value != e.Value {
+			t.Errorf("for input %q, got %v, %v", e.Input, id, err)
+		}
+	}
+}
@@ -31,6 +31,16 @@ func (he *HTTPError) Error() string {
 	return fmt.Sprintf("HTTP error: %v\n%v", he.Res.Status, he.Problem)
 }
 
+// Returns the parsed problem, if any. This allows errors.Is to be used to test
+// an HTTPError against a ProblemType.
+func (he *HTTPError) Unwrap() error {
+	if he.Problem == nil {
+		return nil
+	}
+
+	return he.Problem
+}
+
 func (he *HTTPError) Temporary() bool {
 	switch he.Res.StatusCode {
 	case 202, 408, 500, 502, 503, 504:
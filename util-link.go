@@ -0,0 +1,47 @@
+package acmeapi
+
+import (
+	"github.com/peterhellberg/link"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+var reLinkSeparator = regexp.MustCompile(`,\s*<`)
+
+// Returns the URLs of all links in the Link headers of h having the given
+// relation type, in the order they appear. Relative URLs are resolved
+// against baseURL. Invalid URLs are ignored.
+//
+// This is needed because link.ParseHeader only returns one link per relation
+// type, whereas ACME servers may send multiple links with the same relation
+// type (for example, multiple "alternate" certificate chains).
+func linksByRel(h http.Header, rel, baseURL string) []string {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil
+	}
+
+	var urls []string
+	for _, v := range h["Link"] {
+		for i, part := range reLinkSeparator.Split(v, -1) {
+			if i > 0 {
+				part = "<" + part
+			}
+
+			l := link.Parse(part)[rel]
+			if l == nil {
+				continue
+			}
+
+			u, err := base.Parse(l.URI)
+			if err != nil || !ValidURL(u.String()) {
+				continue
+			}
+
+			urls = append(urls, u.String())
+		}
+	}
+
+	return urls
+}
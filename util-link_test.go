@@ -0,0 +1,29 @@
+package acmeapi
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestLinksByRel(t *testing.T) {
+	h := http.Header{}
+	h.Add("Link", `<https://example.com/acme/directory>;rel="index"`)
+	h.Add("Link", `<https://example.com/acme/cert/1/1>;rel="alternate"`)
+	h.Add("Link", `</acme/cert/1/2>; rel="alternate", <https://example.com/acme/cert/1/3>; rel="alternate"`)
+
+	urls := linksByRel(h, "alternate", "https://example.com/acme/cert/1")
+	expected := []string{
+		"https://example.com/acme/cert/1/1",
+		"https://example.com/acme/cert/1/2",
+		"https://example.com/acme/cert/1/3",
+	}
+	if !reflect.DeepEqual(urls, expected) {
+		t.Fatalf("unexpected links: %#v", urls)
+	}
+
+	urls = linksByRel(h, "next", "https://example.com/")
+	if len(urls) != 0 {
+		t.Fatalf("unexpected links: %#v", urls)
+	}
+}
@@ -2,8 +2,14 @@ package acmeapi
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/hlandau/goutils/clock"
@@ -11,6 +17,137 @@ import (
 
 var defaultClock = clock.Real
 
+// Controls how a RealmClient retries requests which fail in a way which is
+// expected to be transient. The following failures are retried:
+//
+//   - "badNonce" errors, for any request;
+//   - responses with status 429 (Too Many Requests), for any request;
+//   - responses with status 500, 502, 503 or 504, and connection resets,
+//     for requests which do not change server state (GET, HEAD and
+//     POST-as-GET requests).
+//
+// Retries are delayed using exponential backoff, unless the server specifies
+// a delay using a Retry-After header. If the delay requested by the server is
+// longer than MaxRetryAfter, or would end after the deadline of the request
+// context, a *RetryAfterError is returned immediately. A 429 response without
+// a Retry-After header is retried only once, as retrying it repeatedly would
+// only consume more of the rate limit which has been reached.
+//
+// The zero value is a usable default policy.
+type RetryPolicy struct {
+	// Maximum number of attempts made for a request, including the first.
+	// Defaults to 20. Set to 1 to disable retries.
+	MaxTries int
+
+	// Delay before the first retry. The delay doubles for each subsequent
+	// retry, up to MaxDelay. Default 100ms and 1s respectively.
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+
+	// Maximum delay requested via a Retry-After header which will be honoured.
+	// Defaults to 1 minute.
+	MaxRetryAfter time.Duration
+}
+
+func (rp RetryPolicy) withDefaults() RetryPolicy {
+	if rp.MaxTries == 0 {
+		rp.MaxTries = 20
+	}
+	if rp.InitialDelay == 0 {
+		rp.InitialDelay = 100 * time.Millisecond
+	}
+	if rp.MaxDelay == 0 {
+		rp.MaxDelay = 1 * time.Second
+	}
+	if rp.MaxRetryAfter == 0 {
+		rp.MaxRetryAfter = 1 * time.Minute
+	}
+	return rp
+}
+
+// Maximum number of attempts made for a request which receives 429 responses
+// without a Retry-After header.
+const maxRateLimitedTries = 2
+
+// Returns the backoff delay to be used after the given number of failed
+// attempts.
+func (rp *RetryPolicy) backoff(tries int) time.Duration {
+	d := rp.MaxDelay
+	if tries < 32 && rp.InitialDelay<<uint(tries-1) < d {
+		d = rp.InitialDelay << uint(tries-1)
+	}
+
+	// Add up to 10% jitter.
+	return d + time.Duration(rand.Int63n(int64(d)/10+1))
+}
+
+// Determines whether a request which failed with err should be retried. If
+// so, returns the time at which the retry should be made, and whether this
+// time was requested by the server.
+func (rp *RetryPolicy) retryAt(err error, idempotent bool, tries int) (t time.Time, serverRequested, retry bool) {
+	he, isHTTPError := err.(*HTTPError)
+	switch {
+	case isHTTPError && errors.Is(he, ProblemBadNonce):
+	case isHTTPError && he.Res.StatusCode == 429:
+	case isHTTPError && idempotent && isTransientStatusCode(he.Res.StatusCode):
+	case !isHTTPError && idempotent && isConnectionReset(err):
+	default:
+		return time.Time{}, false, false
+	}
+
+	if isHTTPError {
+		if t, ok := parseRetryAfter(he.Res.Header); ok {
+			return t, true, true
+		}
+
+		if he.Res.StatusCode == 429 && tries >= maxRateLimitedTries {
+			return time.Time{}, false, false
+		}
+	}
+
+	return defaultClock.Now().Add(rp.backoff(tries)), false, true
+}
+
+func isTransientStatusCode(code int) bool {
+	switch code {
+	case 500, 502, 503, 504:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns true iff err is an error returned by the HTTP client because the
+// connection was reset or closed before a response was received.
+func isConnectionReset(err error) bool {
+	var ue *url.Error
+	if !errors.As(err, &ue) {
+		return false
+	}
+
+	return errors.Is(ue, syscall.ECONNRESET) || errors.Is(ue, io.EOF) || errors.Is(ue, io.ErrUnexpectedEOF)
+}
+
+// Error returned when a request failed and the server requested that it be
+// retried after a delay which is longer than permitted by the RetryPolicy or
+// which would exceed the deadline of the request context.
+type RetryAfterError struct {
+	// The time at which the server requested that the request be retried.
+	RetryAt time.Time
+
+	// The error returned by the last attempt.
+	Err error
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("server requested retry at %v: %v", e.RetryAt, e.Err)
+}
+
+// Returns the error returned by the last attempt.
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
 func parseRetryAfter(h http.Header) (t time.Time, ok bool) {
 	v := h.Get("Retry-After")
 	if v == "" {
@@ -2,7 +2,10 @@ package acmeapi
 
 import (
 	"context"
+	"errors"
 	"github.com/hlandau/goutils/clock"
+	"gopkg.in/square/go-jose.v2"
+	"net"
 	"net/http"
 	"testing"
 	"time"
@@ -109,3 +112,88 @@ func TestWaitUntil(t *testing.T) {
 		}
 	})
 }
+
+func TestRetryPolicy(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	var tries int
+	var status int
+	var retryAfter string
+	ts.Handle("/res/limited", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		tries++
+		if retryAfter != "" {
+			rw.Header().Set("Retry-After", retryAfter)
+		}
+		ts.writeProblem(rw, 429, &Problem{Type: string(ProblemRateLimited)})
+	})
+	ts.Handle("/res/", func(rw http.ResponseWriter, req *http.Request, jws *jose.JSONWebSignature, payload []byte) {
+		tries++
+		if tries == 1 && req.URL.Path == "/res/reset" {
+			conn, _, err := rw.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("%v", err)
+				return
+			}
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+			return
+		}
+		if tries == 1 {
+			if retryAfter != "" {
+				rw.Header().Set("Retry-After", retryAfter)
+			}
+			ts.writeProblem(rw, status, &Problem{Type: string(ProblemServerInternal)})
+			return
+		}
+
+		ts.writeJSON(rw, 200, map[string]interface{}{})
+	})
+
+	rc := ts.Client()
+	acct := &Account{URL: ts.URL + "/acct/1", PrivateKey: newTestKey(t)}
+
+	tests := []struct {
+		Path       string
+		Status     int
+		RetryAfter string
+		Request    interface{}
+		Tries      int
+		Error      bool
+	}{
+		// Transient errors and connection resets are retried for POST-as-GET.
+		{"/res/1", 503, "", "", 2, false},
+		{"/res/reset", 0, "", "", 2, false},
+		// Only rate limiting is retried for other POSTs.
+		{"/res/1", 503, "", map[string]interface{}{}, 1, true},
+		{"/res/1", 429, "0", map[string]interface{}{}, 2, false},
+		{"/res/1", 400, "", "", 1, true},
+		// Retry-After exceeding the maximum fails immediately.
+		{"/res/1", 429, "3600", "", 1, true},
+		// Rate limiting without Retry-After is retried only once.
+		{"/res/1", 429, "", "", 2, false},
+		{"/res/limited", 0, "", "", 2, true},
+		{"/res/limited", 0, "", map[string]interface{}{}, 2, true},
+		// Rate limiting with Retry-After is retried up to the attempt limit.
+		{"/res/limited", 0, "0", "", 20, true},
+	}
+
+	for i, tst := range tests {
+		tries, status, retryAfter = 0, tst.Status, tst.RetryAfter
+		var res map[string]interface{}
+		_, err := rc.doReq(context.TODO(), "POST", ts.URL+tst.Path, acct, nil, tst.Request, &res)
+		if (err != nil) != tst.Error || tries != tst.Tries {
+			t.Fatalf("test %d: unexpected result: %v, %d tries", i, err, tries)
+		}
+	}
+
+	// A Retry-After beyond the context deadline fails immediately.
+	tries, status, retryAfter = 0, 503, "30"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := rc.doReq(ctx, "POST", ts.URL+"/res/1", acct, nil, "", nil)
+	rae, ok := err.(*RetryAfterError)
+	if !ok || tries != 1 || !errors.Is(rae, ProblemServerInternal) {
+		t.Fatalf("expected RetryAfterError, got %v", err)
+	}
+}